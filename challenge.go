@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/chewxy/nanjingtaxi/kademlia"
+	"github.com/vmihailenco/msgpack"
+)
+
+// challenges: a room requester proves it's a member by signing a challenge with its member key. A challenge is a fresh
+// random nonce, along with who it's for, who issued it, which room it's for, when it was issued, and the handshake it's
+// part of (see handshake.go) - so a response can't be replayed, whether to the same issuer or another one, for another
+// room, or later on.
+// The issuer holds on to the challenge it sent (by the token), accepts one response to it, and only within CHALLENGE_WINDOW.
+// The requester checks the challenge is really meant for it before signing, so it can't be used to sign someone else's
+const (
+	CHALLENGE_NONCE_SIZE = 32
+	CHALLENGE_WINDOW     = 30 * time.Second
+)
+
+var (
+	errChallengeExpired  = errors.New("challenge is too old")
+	errChallengeMismatch = errors.New("challenge isn't for this exchange")
+)
+
+type challenge struct {
+	RoomID    string
+	Nonce     []byte
+	Requester kademlia.NodeID
+	Issuer    kademlia.NodeID
+	Issued    int64  // unix nanoseconds
+	Handshake []byte // the handshake hash
+}
+
+// pendingChallenge is what the issuer keeps of a challenge it sent, until it's answered
+type pendingChallenge struct {
+	challenge
+	raw     []byte // exactly what was sent, which is what's signed
+	session *session
+	sent    sealedChallenge // the CHALLENGE as it went out, in case the request's resent
+}
+
+func newChallenge(roomID string, requester, issuer kademlia.NodeID, s *session) (*pendingChallenge, error) {
+	nonce := make([]byte, CHALLENGE_NONCE_SIZE)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	ch := challenge{roomID, nonce, requester, issuer, time.Now().UnixNano(), s.transcript}
+	raw, err := msgpack.Marshal(ch)
+	if err != nil {
+		return nil, err
+	}
+	return &pendingChallenge{challenge: ch, raw: raw, session: s}, nil
+}
+
+// check makes sure the challenge is for the room, between the requester and issuer, part of the handshake, and still fresh.
+// Clocks aren't always in sync, so a challenge from a little in the future is fine too
+func (ch challenge) check(roomID string, requester, issuer kademlia.NodeID, s *session) error {
+	if ch.RoomID != roomID || !bytes.Equal(ch.Requester, requester) || !bytes.Equal(ch.Issuer, issuer) || len(ch.Nonce) != CHALLENGE_NONCE_SIZE {
+		return errChallengeMismatch
+	}
+	if !bytes.Equal(ch.Handshake, s.transcript) {
+		return errChallengeMismatch
+	}
+
+	age := time.Since(time.Unix(0, ch.Issued))
+	if age > CHALLENGE_WINDOW || age < -CHALLENGE_WINDOW {
+		return errChallengeExpired
+	}
+	return nil
+}
+
+func challengeDigest(raw []byte) []byte {
+	sum := sha256.Sum256(raw)
+	return sum[:]
+}
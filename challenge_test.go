@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chewxy/nanjingtaxi/kademlia"
+	"github.com/vmihailenco/msgpack"
+)
+
+// a room request that's sent again (because the challenge didn't get through) gets the same challenge, not a new one
+func TestResentRequestGetsSameChallenge(t *testing.T) {
+	mn := kademlia.NewMemoryNetwork(1)
+	issuer := newClient()
+	issuer.Network = kademlia.NewKademlia()
+	issuer.Network.Node = issuer.Node
+	issuer.Network.Timeout = time.Minute // no resends of the challenge from the issuer's end
+	var err error
+	if issuer.Network.Transport, err = mn.Listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	issuer.Network.Handle("REQUEST_ROOM", issuer.issueChallenge)
+	go issuer.Network.Run()
+	defer issuer.Network.Close()
+
+	room := createChatroom()
+	issuer.addRoom(room)
+
+	requester, err := mn.Listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, err := newEphemeral()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _ := kademlia.NewMessage()
+	request.MessageType = "REQUEST_ROOM"
+	request.SourceID = kademlia.NewNode().ID
+	request.InsertMessage(roomRequest{room.ID, ephemeral.PublicKey().Bytes()})
+	b, err := msgpack.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var challenges [][]byte
+	for len(challenges) < 2 {
+		if err := requester.Send(b, issuer.Network.Transport.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			packet, _, err := requester.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg kademlia.Message
+			if err := msgpack.Unmarshal(packet, &msg); err != nil || msg.MessageType != "CHALLENGE" {
+				continue // pings and such
+			}
+			if msg.Token != request.Token {
+				t.Fatalf("challenge is for %s. Expected %s", msg.Token, request.Token)
+			}
+			p, _ := kademlia.Payload(msg.Message)
+			challenges = append(challenges, p)
+			break
+		}
+	}
+
+	if !bytes.Equal(challenges[0], challenges[1]) {
+		t.Error("the resent request got a new challenge")
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack"
+)
+
+// delivery: every text message has an ID and a sequence number (per sender, per room), and is sent to each participant
+// until it's acked, backing off each time. The receivers ack everything they get - duplicates too, since it's probably
+// the ack that went missing - but only show each message once, and in the order each sender sent them.
+// Lamport timestamps order the room log across senders, so replies never come before what they're replying to
+const (
+	RETRANSMIT_INTERVAL     = 500 * time.Millisecond // how long to wait for the first ack before resending
+	MAX_RETRANSMIT_INTERVAL = 30 * time.Second
+	MAX_RETRANSMITS         = 8                // after this many resends, the participant is given up on
+	GAP_TIMEOUT             = 2 * time.Minute  // how long to hold on to messages after a gap before giving up on the missing ones
+	GAP_CHECK_INTERVAL      = 10 * time.Second // how often gaps are checked on, for senders that have gone quiet
+)
+
+// senderState is what a room knows about each sender: the sequence number that's due next, and the messages that came early
+type senderState struct {
+	next    uint64
+	held    map[uint64]Message
+	waiting time.Time // when the first message after the gap arrived
+}
+
+// newText makes a text message for the room, stamped with the next sequence number and Lamport time
+func (room *chatroom) newText(sender, nickname string, identity []byte, text string) Message {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	room.sequence++
+	room.clock++
+	msg := Message{
+		Type:        TextMessage,
+		Destination: room.ID,
+		Message:     []byte(text),
+
+		ID:       uuid.New().String(),
+		Sender:   sender,
+		Sequence: room.sequence,
+		Lamport:  room.clock,
+
+		Nickname: nickname,
+		Identity: identity,
+	}
+	room.record(msg)
+	return msg
+}
+
+// sender returns what's known about the sender. Sequence numbers start at 1, so unless we've been told where the sender's
+// at (see expect), that's what's waited on first. It's called with the lock held
+func (room *chatroom) sender(sender string) *senderState {
+	s, ok := room.senders[sender]
+	if !ok {
+		s = &senderState{next: 1, held: make(map[uint64]Message)}
+		room.senders[sender] = s
+	}
+	return s
+}
+
+// expect tells the room which sequence number is due next from a sender we haven't heard from yet. It comes with their
+// sender key, so whatever they sent before we joined isn't waited on
+func (room *chatroom) expect(sender string, next uint64) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	if _, ok := room.senders[sender]; !ok {
+		room.senders[sender] = &senderState{next: next, held: make(map[uint64]Message)}
+	}
+}
+
+// receive takes in a text message, and returns the messages that can now be shown, in order. Duplicates return nothing.
+// If a gap has been open for too long, the missing messages are skipped, and how many were skipped is returned
+func (room *chatroom) receive(msg Message) (deliverable []Message, lost uint64) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	s := room.sender(msg.Sender)
+
+	if msg.Sequence < s.next {
+		return nil, 0 // seen it
+	}
+	if _, ok := s.held[msg.Sequence]; ok {
+		return nil, 0 // seen it too
+	}
+	if len(s.held) == 0 {
+		s.waiting = time.Now()
+	}
+	s.held[msg.Sequence] = msg
+
+	if time.Since(s.waiting) > GAP_TIMEOUT {
+		lost = s.skip()
+	}
+	return room.deliver(s), lost
+}
+
+// overdue gives up on the gaps that have been open for longer than GAP_TIMEOUT, and returns the messages that can now be
+// shown and how many were skipped. receive only does this when something comes in from the sender - this is for when
+// nothing more does
+func (room *chatroom) overdue(now time.Time) (deliverable []Message, lost uint64) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	senders := make([]string, 0, len(room.senders))
+	for sender := range room.senders {
+		senders = append(senders, sender)
+	}
+	sort.Strings(senders)
+
+	for _, sender := range senders {
+		s := room.senders[sender]
+		if len(s.held) == 0 || now.Sub(s.waiting) <= GAP_TIMEOUT {
+			continue
+		}
+		lost += s.skip()
+		deliverable = append(deliverable, room.deliver(s)...)
+	}
+	return deliverable, lost
+}
+
+// skip skips over the gap, to the earliest message that's held, and returns how many messages were skipped. There has to
+// be one held
+func (s *senderState) skip() (lost uint64) {
+	if _, ok := s.held[s.next]; ok {
+		return 0 // no gap
+	}
+	earliest := uint64(0)
+	for seq := range s.held {
+		if earliest == 0 || seq < earliest {
+			earliest = seq
+		}
+	}
+	lost = earliest - s.next
+	s.next = earliest
+	return lost
+}
+
+// deliver takes the sender's held messages that are next in line, and puts them in the room log. It's called with the lock held
+func (room *chatroom) deliver(s *senderState) (deliverable []Message) {
+	for {
+		m, ok := s.held[s.next]
+		if !ok {
+			break
+		}
+		delete(s.held, s.next)
+		s.next++
+		s.waiting = time.Now()
+
+		if m.Lamport > room.clock {
+			room.clock = m.Lamport
+		}
+		room.clock++
+		room.record(m)
+		deliverable = append(deliverable, m)
+	}
+	return deliverable
+}
+
+// seen says whether the message has already been received. It's called before the message is opened, as its key is gone
+// once it has been
+func (room *chatroom) seen(msg Message) bool {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	s, ok := room.senders[msg.Sender]
+	if !ok {
+		return false
+	}
+	if msg.Sequence < s.next {
+		return true
+	}
+	_, held := s.held[msg.Sequence]
+	return held
+}
+
+// record puts the message in the room log, which is kept in Lamport order. Ties are broken by sender, so everyone has the same log.
+// It's called with the lock held
+func (room *chatroom) record(msg Message) {
+	i := sort.Search(len(room.log), func(i int) bool {
+		l := room.log[i]
+		return l.Lamport > msg.Lamport || (l.Lamport == msg.Lamport && l.Sender > msg.Sender)
+	})
+	room.log = append(room.log, Message{})
+	copy(room.log[i+1:], room.log[i:])
+	room.log[i] = msg
+}
+
+// Log returns a copy of the room log
+func (room *chatroom) Log() []Message {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	return append([]Message(nil), room.log...)
+}
+
+// sendReliably sends the message to the participant until it's acked, or until it's been resent MAX_RETRANSMITS times
+func (c *client) sendReliably(participant string, address *net.UDPAddr, msg Message) {
+	key := msg.ID + "/" + participant
+	acked := make(chan struct{})
+
+	c.ackLock.Lock()
+	c.awaitingAck[key] = acked
+	c.ackLock.Unlock()
+
+	defer func() {
+		c.ackLock.Lock()
+		delete(c.awaitingAck, key)
+		c.ackLock.Unlock()
+	}()
+
+	interval := RETRANSMIT_INTERVAL
+	for attempt := 0; attempt <= MAX_RETRANSMITS; attempt++ {
+		sendMsg(c.transport, address, msg)
+
+		select {
+		case <-acked:
+			return
+		case <-time.After(interval):
+		}
+
+		if interval *= 2; interval > MAX_RETRANSMIT_INTERVAL {
+			interval = MAX_RETRANSMIT_INTERVAL
+		}
+	}
+	c.ui <- fmt.Sprintf("...%s did not acknowledge a message after %d attempts", address, MAX_RETRANSMITS+1)
+}
+
+// skipGaps gives up on missing messages once their gap has been open for GAP_TIMEOUT, even if nothing more comes in from
+// the sender to prompt it
+func (c *client) skipGaps() {
+	ticker := time.NewTicker(GAP_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, room := range c.rooms() {
+				delivered, lost := room.overdue(now)
+				c.show(room, delivered, lost)
+			}
+		case <-c.kill:
+			return
+		}
+	}
+}
+
+// ackBody is what AckMessage carries
+type ackBody struct {
+	ID string // of the message being acked
+}
+
+// ack acknowledges a message. It goes back to wherever the message came from. Acks are sealed and signed like everything
+// else, so no one but a member of the room can stop a message from being resent
+func (c *client) ack(room *chatroom, msg Message, from *net.UDPAddr) {
+	ack, err := c.newControl(room, AckMessage, ackBody{msg.ID})
+	if err == nil {
+		ack, err = c.secure(room, ack)
+	}
+	if err != nil {
+		log.Printf("Unable to ack %s. Error was: %s", msg.ID, err)
+		return
+	}
+	sendMsg(c.transport, from, ack)
+}
+
+// acked takes in an ack that's been authenticated
+func (c *client) acked(msg Message) {
+	var body ackBody
+	if err := msgpack.Unmarshal(msg.Message, &body); err != nil {
+		log.Printf("Unable to unmarshal ack %s: %s", msg.ID, err)
+		return
+	}
+
+	c.ackLock.Lock()
+	defer c.ackLock.Unlock()
+
+	key := body.ID + "/" + msg.Sender
+	if acked, ok := c.awaitingAck[key]; ok {
+		close(acked)
+		delete(c.awaitingAck, key)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func text(sender string, sequence, lamport uint64) Message {
+	return Message{Type: TextMessage, Sender: sender, Sequence: sequence, Lamport: lamport, Message: []byte(sender)}
+}
+
+// the first two messages from a sender arrive the wrong way round. Both should be shown, in order
+func TestReceiveOutOfOrder(t *testing.T) {
+	room := newChatroom("room", nil, nil, nil)
+
+	delivered, lost := room.receive(text("a", 2, 2))
+	if len(delivered) != 0 || lost != 0 {
+		t.Fatalf("m2 shouldn't be shown before m1. Got %v, %d lost", delivered, lost)
+	}
+	if room.seen(text("a", 1, 1)) {
+		t.Fatal("m1 hasn't been seen")
+	}
+
+	delivered, lost = room.receive(text("a", 1, 1))
+	if len(delivered) != 2 || delivered[0].Sequence != 1 || delivered[1].Sequence != 2 || lost != 0 {
+		t.Fatalf("expected m1 then m2. Got %v, %d lost", delivered, lost)
+	}
+	if len(room.Log()) != 2 {
+		t.Fatalf("expected both in the log. Got %v", room.Log())
+	}
+	if !room.seen(text("a", 1, 1)) || !room.seen(text("a", 2, 2)) {
+		t.Fatal("m1 and m2 have been seen")
+	}
+}
+
+// someone who joins late is told where the sender's at, and doesn't wait on what was sent before
+func TestReceiveFromExpected(t *testing.T) {
+	room := newChatroom("room", nil, nil, nil)
+	room.expect("a", 5)
+	room.expect("a", 1) // too late. Already told
+
+	delivered, _ := room.receive(text("a", 6, 6))
+	if len(delivered) != 0 {
+		t.Fatalf("m6 shouldn't be shown before m5. Got %v", delivered)
+	}
+	delivered, _ = room.receive(text("a", 5, 5))
+	if len(delivered) != 2 {
+		t.Fatalf("expected m5 then m6. Got %v", delivered)
+	}
+	if delivered, _ = room.receive(text("a", 4, 4)); len(delivered) != 0 {
+		t.Fatalf("m4 was from before we joined. Got %v", delivered)
+	}
+}
+
+// a sender's message goes missing and nothing more comes from them. The gap's still given up on, and what came after it shown
+func TestOverdueGapIsSkipped(t *testing.T) {
+	room := newChatroom("room", nil, nil, nil)
+	room.receive(text("a", 1, 1))
+	room.receive(text("a", 3, 3))
+	room.receive(text("a", 4, 4))
+	room.receive(text("b", 2, 5)) // b's gap is newer
+
+	if delivered, lost := room.overdue(time.Now()); len(delivered) != 0 || lost != 0 {
+		t.Fatalf("nothing's overdue yet. Got %v, %d lost", delivered, lost)
+	}
+
+	room.lock.Lock()
+	room.senders["a"].waiting = time.Now().Add(-GAP_TIMEOUT - time.Second)
+	room.lock.Unlock()
+
+	delivered, lost := room.overdue(time.Now())
+	if len(delivered) != 2 || delivered[0].Sequence != 3 || delivered[1].Sequence != 4 || lost != 1 {
+		t.Fatalf("expected m3 and m4 from a, with m2 lost. Got %v, %d lost", delivered, lost)
+	}
+	if delivered, _ = room.receive(text("a", 2, 2)); len(delivered) != 0 {
+		t.Fatalf("m2 was given up on. Got %v", delivered)
+	}
+	if !room.seen(text("b", 2, 5)) || room.seen(text("b", 1, 1)) {
+		t.Fatal("b's gap isn't overdue, and should still be open")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// encryption: every room has a 32 byte room key. It's made when the room is created and handed out with the invites, so only
+// members have it - it never goes over the network. Messages are sealed with AES-256-GCM under the room key (text messages
+// under a sender key instead - see senderkeys.go), with a random nonce in front of the ciphertext. The room ID and the rest
+// of the header are the associated data, so a message can't be replayed into another room, or have its sender or sequence
+// number changed, without it failing to open. Who sent it - their nickname and identity, and the identity signature (see
+// identity.go) - is sealed in along with the body, so it's only ever seen by members
+const ROOM_KEY_SIZE = 32
+
+var errTampered = errors.New("message failed to authenticate")
+
+func newRoomKey() []byte {
+	key := make([]byte, ROOM_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		panic(err) // no randomness, no crypto
+	}
+	return key
+}
+
+func writeRoomKey(filename string, key []byte) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: "ROOM KEY", Bytes: key})
+}
+
+func readRoomKey(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	switch {
+	case block == nil:
+		return nil, fmt.Errorf("%s is not a pem encoded file", filename)
+	case block.Type != "ROOM KEY":
+		return nil, fmt.Errorf("incorrect pem type in %s. Expected ROOM KEY", filename)
+	case len(block.Bytes) != ROOM_KEY_SIZE:
+		return nil, fmt.Errorf("room key in %s is %d bytes. Expected %d", filename, len(block.Bytes), ROOM_KEY_SIZE)
+	}
+	return block.Bytes, nil
+}
+
+// associatedData is what's authenticated but not encrypted: everything in the header that the receiver acts on
+func associatedData(msg Message) []byte {
+	return []byte(fmt.Sprintf("%d|%s|%s|%s|%d|%d|%s|%d", msg.Type, msg.Destination, msg.ID, msg.Sender, msg.Sequence, msg.Lamport, msg.Chain, msg.Generation))
+}
+
+// sealedBody is what's encrypted: the body, and who it's from
+type sealedBody struct {
+	Message           []byte
+	Nickname          string
+	Identity          []byte
+	IdentitySignature []byte
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns a copy of the message with the body encrypted under the room key
+func (room *chatroom) seal(msg Message) (Message, error) {
+	return sealUnder(room.roomKey, msg)
+}
+
+// open returns a copy of the message with the body decrypted with the room key. Anything that's been tampered with (or
+// wasn't sealed with this room's key) returns errTampered
+func (room *chatroom) open(msg Message) (Message, error) {
+	return openUnder(room.roomKey, msg)
+}
+
+func sealUnder(key []byte, msg Message) (Message, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return msg, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return msg, err
+	}
+
+	b, err := msgpack.Marshal(sealedBody{msg.Message, msg.Nickname, msg.Identity, msg.IdentitySignature})
+	if err != nil {
+		return msg, err
+	}
+	msg.Message = aead.Seal(nonce, nonce, b, associatedData(msg))
+	return msg, nil
+}
+
+func openUnder(key []byte, msg Message) (Message, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return msg, err
+	}
+
+	if len(msg.Message) < aead.NonceSize()+aead.Overhead() {
+		return msg, errTampered
+	}
+	nonce, ciphertext := msg.Message[:aead.NonceSize()], msg.Message[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, associatedData(msg))
+	if err != nil {
+		return msg, errTampered
+	}
+	var body sealedBody
+	if err := msgpack.Unmarshal(plaintext, &body); err != nil {
+		return msg, errTampered
+	}
+	msg.Message, msg.Nickname, msg.Identity, msg.IdentitySignature = body.Message, body.Nickname, body.Identity, body.IdentitySignature
+	return msg, nil
+}
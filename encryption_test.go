@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+// a sealed message only opens as it was sent, in the room it was sent to
+func TestSealedMessagesAreAuthenticated(t *testing.T) {
+	room := newChatroom("room", nil, nil, nil)
+	room.roomKey = newRoomKey()
+	sent := Message{Type: TextMessage, Destination: "room", ID: "1", Sender: "a", Sequence: 1, Message: []byte("hello"), Nickname: "a"}
+
+	sealed, err := room.seal(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := room.open(sealed); err != nil || string(opened.Message) != "hello" || opened.Nickname != "a" {
+		t.Fatalf("expected the message back. Got %q from %q, %v", opened.Message, opened.Nickname, err)
+	}
+
+	cases := []struct {
+		name   string
+		tamper func(*Message)
+	}{
+		{"ciphertext", func(m *Message) { m.Message[len(m.Message)-1] ^= 1 }},
+		{"truncated", func(m *Message) { m.Message = m.Message[:4] }},
+		{"another room", func(m *Message) { m.Destination = "other room" }},
+		{"another sender", func(m *Message) { m.Sender = "b" }},
+		{"another sequence", func(m *Message) { m.Sequence = 2 }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := sealed
+			msg.Message = append([]byte(nil), sealed.Message...)
+			tc.tamper(&msg)
+			if _, err := room.open(msg); err != errTampered {
+				t.Errorf("expected errTampered. Got %v", err)
+			}
+		})
+	}
+
+	other := newChatroom("room", nil, nil, nil)
+	other.roomKey = newRoomKey()
+	if _, err := other.open(sealed); err != errTampered {
+		t.Errorf("opened under another room key. Got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/agl/pond/bbssig"
+)
+
+// handshake: joining a room is wrapped in a key agreement, loosely after the Noise NN pattern, so nothing in it can be read
+// (or usefully altered) by anyone on the network:
+//
+//	REQUEST_ROOM        requester -> issuer     room ID, e_r
+//	CHALLENGE           issuer -> requester     e_i, sig_i(h), seal(challenge)
+//	CHALLENGE_RESPONSE  requester -> issuer     seal(answer)
+//	ADMITTED            issuer -> requester     seal(room details)
+//
+// e_r and e_i are fresh X25519 keys. h is the hash of everything so far - the room ID and both ephemeral keys - and the
+// session keys (one for each direction) come out of HKDF over the shared secret, salted with h.
+// Neither side has a long term key the other knows, so the handshake is authenticated by room membership instead: the
+// issuer signs h with its member key, and the challenge the requester signs has h in it. Anyone in the middle swapping
+// ephemeral keys ends up with a different h on each side, and neither signature checks out
+const HANDSHAKE_PROTOCOL = "nanjingtaxi join v1"
+
+// every handshake message that's sealed has its own nonce. They're never reused, as the keys are new every time
+const (
+	NONCE_CHALLENGE = iota + 1
+	NONCE_RESPONSE
+	NONCE_ADMITTED
+)
+
+var errBadHandshake = errors.New("handshake failed to authenticate")
+
+// roomRequest is what REQUEST_ROOM carries
+type roomRequest struct {
+	RoomID    string
+	Ephemeral []byte
+}
+
+// sealedChallenge is what CHALLENGE carries
+type sealedChallenge struct {
+	Ephemeral []byte
+	Signature []byte // the issuer's group signature of h
+	Sealed    []byte // the challenge
+}
+
+// joinRequest is what the requester keeps with the token while the handshake goes on
+type joinRequest struct {
+	roomID    string
+	ephemeral *ecdh.PrivateKey
+	session   *session // once the challenge is in
+}
+
+// session is one side of a handshake, once both ephemeral keys are known
+type session struct {
+	transcript []byte // h
+	toIssuer   cipher.AEAD
+	toRequest  cipher.AEAD // to the requester
+}
+
+func newEphemeral() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// newSession works out the session keys from our ephemeral key and their ephemeral public key
+func newSession(roomID string, ours *ecdh.PrivateKey, theirs []byte, weRequested bool) (*session, error) {
+	requester, issuer := ours.PublicKey().Bytes(), theirs
+	if !weRequested {
+		requester, issuer = issuer, requester
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(theirs)
+	if err != nil {
+		return nil, errBadHandshake
+	}
+	shared, err := ours.ECDH(pub)
+	if err != nil {
+		return nil, errBadHandshake
+	}
+
+	h := sha256.New()
+	h.Write([]byte(HANDSHAKE_PROTOCOL))
+	h.Write([]byte(roomID))
+	h.Write(requester)
+	h.Write(issuer)
+	s := &session{transcript: h.Sum(nil)}
+
+	// HKDF (RFC 5869) - extract with h as the salt, then a block of output for each direction
+	extract := hmac.New(sha256.New, s.transcript)
+	extract.Write(shared)
+	prk := extract.Sum(nil)
+
+	expand := func(label string) (cipher.AEAD, error) {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write([]byte(label))
+		mac.Write([]byte{1})
+		block, err := aes.NewCipher(mac.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	if s.toIssuer, err = expand("requester to issuer"); err != nil {
+		return nil, err
+	}
+	if s.toRequest, err = expand("issuer to requester"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func handshakeNonce(aead cipher.AEAD, n byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	nonce[len(nonce)-1] = n
+	return nonce
+}
+
+func (s *session) seal(aead cipher.AEAD, n byte, plaintext []byte) []byte {
+	return aead.Seal(nil, handshakeNonce(aead, n), plaintext, s.transcript)
+}
+
+func (s *session) open(aead cipher.AEAD, n byte, sealed []byte) ([]byte, error) {
+	plaintext, err := aead.Open(nil, handshakeNonce(aead, n), sealed, s.transcript)
+	if err != nil {
+		return nil, errBadHandshake
+	}
+	return plaintext, nil
+}
+
+// transcriptDigest is what the issuer signs to show it's a member of the room
+func (s *session) transcriptDigest() []byte {
+	sum := sha256.Sum256(append([]byte("issuer "), s.transcript...))
+	return sum[:]
+}
+
+func (s *session) signTranscript(memberKey *bbssig.MemberKey) ([]byte, error) {
+	return memberKey.Sign(rand.Reader, s.transcriptDigest(), sha256.New())
+}
+
+func (s *session) verifyTranscript(group *bbssig.Group, sig []byte) bool {
+	return group.Verify(s.transcriptDigest(), sha256.New(), sig)
+}
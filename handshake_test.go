@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"testing"
+)
+
+func newHandshakeKey(t *testing.T) *ecdh.PrivateKey {
+	k, err := newEphemeral()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func newHandshakeSession(t *testing.T, roomID string, ours *ecdh.PrivateKey, theirs *ecdh.PrivateKey, weRequested bool) *session {
+	s, err := newSession(roomID, ours, theirs.PublicKey().Bytes(), weRequested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// both ends of a handshake that no one's in the middle of work out the same keys, and the issuer's signature checks out
+func TestHandshake(t *testing.T) {
+	room := createChatroom()
+	e_r, e_i := newHandshakeKey(t), newHandshakeKey(t)
+	requester := newHandshakeSession(t, room.ID, e_r, e_i, true)
+	issuer := newHandshakeSession(t, room.ID, e_i, e_r, false)
+
+	sig, err := issuer.signTranscript(room.memberPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !requester.verifyTranscript(room.groupPublicKey, sig) {
+		t.Fatal("the issuer's signature didn't check out")
+	}
+	challenge, err := requester.open(requester.toRequest, NONCE_CHALLENGE, issuer.seal(issuer.toRequest, NONCE_CHALLENGE, []byte("challenge")))
+	if err != nil || string(challenge) != "challenge" {
+		t.Fatalf("expected the challenge. Got %q, %v", challenge, err)
+	}
+
+	// the same keys for another room don't make the same session
+	other := newHandshakeSession(t, "other room", e_r, e_i, true)
+	if other.verifyTranscript(room.groupPublicKey, sig) {
+		t.Error("the signature checked out for another room")
+	}
+}
+
+// mallory sits between the requester and the issuer, and swaps in ephemeral keys of her own. She isn't a member of the
+// room, so there's nothing she can send the requester that'll get past the challenge
+func TestHandshakeMITM(t *testing.T) {
+	room := createChatroom()
+	e_r, e_i := newHandshakeKey(t), newHandshakeKey(t)
+	m_r, m_i := newHandshakeKey(t), newHandshakeKey(t) // what mallory sends the requester, and the issuer
+
+	requester := newHandshakeSession(t, room.ID, e_r, m_r, true)
+	issuer := newHandshakeSession(t, room.ID, e_i, m_i, false)
+	mallorysRequester := newHandshakeSession(t, room.ID, m_r, e_r, false)
+	mallorysIssuer := newHandshakeSession(t, room.ID, m_i, e_i, true)
+
+	if bytes.Equal(requester.transcript, issuer.transcript) {
+		t.Fatal("both sides ended up with the same transcript")
+	}
+
+	// the issuer's signature, passed on
+	sig, err := issuer.signTranscript(room.memberPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mallorysIssuer.verifyTranscript(room.groupPublicKey, sig) {
+		t.Fatal("mallory's session with the issuer should be the issuer's")
+	}
+	if requester.verifyTranscript(room.groupPublicKey, sig) {
+		t.Error("the issuer's signature, passed on, checked out for the requester")
+	}
+
+	// one of her own, with a member key of another room
+	outsiders := createChatroom()
+	if sig, err = mallorysRequester.signTranscript(outsiders.memberPrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	if requester.verifyTranscript(room.groupPublicKey, sig) {
+		t.Error("a signature by a member key of another room checked out")
+	}
+
+	// and the issuer's sealed challenge, passed on as it is, doesn't open
+	if _, err := requester.open(requester.toRequest, NONCE_CHALLENGE, issuer.seal(issuer.toRequest, NONCE_CHALLENGE, []byte("challenge"))); err != errBadHandshake {
+		t.Errorf("expected %q. Got %v", errBadHandshake, err)
+	}
+}
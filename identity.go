@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/chewxy/nanjingtaxi/kademlia"
+)
+
+// identity: every user has an RSA key (pem.pem - see publickey.go) and picks a nickname, which can be different in every room.
+// Each message carries the sender's nickname and public key, and is signed with the private key, so the nickname can't be
+// put on someone else's messages. All three are sealed in with the body (see encryption.go), so only members see them. Nicknames aren't unique, so they're always shown with the fingerprint of the key.
+// Node IDs are made from the key too (see nodeIDOf), so no one can send as someone else's node ID either
+const (
+	FINGERPRINT_SIZE  = 8 // bytes of the key's sha256 that are shown
+	MAX_NICKNAME_SIZE = 32
+	DEFAULT_NICKNAME  = "anonymous"
+)
+
+var (
+	errBadIdentity      = errors.New("message is not signed by the identity it carries")
+	errIdentityMismatch = errors.New("node ID isn't the one that goes with the identity")
+)
+
+// fingerprint is the short, human comparable form of a public key (DER encoded)
+func fingerprint(identity []byte) string {
+	sum := sha256.Sum256(identity)
+	hex := make([]string, FINGERPRINT_SIZE/2)
+	for i := range hex {
+		hex[i] = fmt.Sprintf("%x", sum[2*i:2*i+2])
+	}
+	return strings.Join(hex, ":")
+}
+
+// nodeIDOf is the node ID that goes with an identity: the start of the sha256 of the public key. Everyone's node ID is
+// made this way, so a node ID can only be had by whoever has the key it's made from - there's nothing to take on trust
+func nodeIDOf(identity []byte) kademlia.NodeID {
+	sum := sha256.Sum256(identity)
+	return kademlia.NodeID(sum[:kademlia.ID_SIZE])
+}
+
+// displayName is how the sender of a message is shown: nickname (fingerprint)
+func displayName(msg Message) string {
+	return fmt.Sprintf("%s (%s)", msg.Nickname, fingerprint(msg.Identity))
+}
+
+func validNickname(nickname string) error {
+	switch {
+	case nickname == "":
+		return errors.New("nickname is empty")
+	case len(nickname) > MAX_NICKNAME_SIZE:
+		return fmt.Errorf("nickname is longer than %d bytes", MAX_NICKNAME_SIZE)
+	case strings.ContainsAny(nickname, "\r\n"):
+		return errors.New("nickname has a line break in it")
+	}
+	return nil
+}
+
+// identityDigest is what the identity signature covers: the header, who it's from, and the body before it's sealed. The
+// chain and generation are left out, as they're picked as a text message is sealed - the sealing covers those
+func identityDigest(msg Message) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d|%s|%s|%s|%d|%d|%q|%x|", msg.Type, msg.Destination, msg.ID, msg.Sender, msg.Sequence, msg.Lamport, msg.Nickname, msg.Identity)
+	h.Write(msg.Message)
+	return h.Sum(nil)
+}
+
+// signIdentity returns a copy of the message, signed with our RSA key. It's signed before it's sealed, as the signature
+// is sealed in with the body
+func signIdentity(msg Message, priv *rsa.PrivateKey) (Message, error) {
+	digest := identityDigest(msg)
+	sig, err := rsa.SignPSS(rand.Reader, priv, crypto.SHA256, digest, nil)
+	if err != nil {
+		return msg, err
+	}
+	msg.IdentitySignature = sig
+	return msg, nil
+}
+
+// parseIdentity gets the RSA public key out of an identity
+func parseIdentity(identity []byte) (*rsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(identity)
+	if err != nil {
+		return nil, errBadIdentity
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errBadIdentity
+	}
+	return pub, nil
+}
+
+// verifyIdentity checks that the message was signed by the key it carries, and that the key is the sender's. The message
+// has to have been opened
+func verifyIdentity(msg Message) error {
+	if err := validNickname(msg.Nickname); err != nil {
+		return err
+	}
+
+	pub, err := parseIdentity(msg.Identity)
+	if err != nil {
+		return err
+	}
+	if msg.Sender != string(nodeIDOf(msg.Identity)) {
+		return errIdentityMismatch
+	}
+
+	if err := rsa.VerifyPSS(pub, crypto.SHA256, identityDigest(msg), msg.IdentitySignature, nil); err != nil {
+		return errBadIdentity
+	}
+	return nil
+}
+
+// bindIdentity checks that the identity is the participant's - their node ID has to be the one made from it - and
+// remembers it, so there's something to seal their new keys to when the room is rekeyed. Nothing is taken on anyone's
+// word: whoever it comes from, an identity that doesn't go with the node ID is refused
+func (room *chatroom) bindIdentity(participant string, identity []byte) error {
+	pub, err := parseIdentity(identity)
+	if err != nil {
+		return err
+	}
+	if participant != string(nodeIDOf(identity)) {
+		return errIdentityMismatch
+	}
+
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	room.publicKeys[participant] = pub
+	return nil
+}
+
+// identify remembers who's using which nickname in the room. If someone else in the room already goes by the same
+// nickname, the other fingerprint is returned, so the user can be told
+func (room *chatroom) identify(msg Message) (clash string) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	fp := fingerprint(msg.Identity)
+	room.nicknames[fp] = msg.Nickname
+	for other, nickname := range room.nicknames {
+		if other != fp && nickname == msg.Nickname {
+			return other
+		}
+	}
+	return ""
+}
+
+// nickname is what we go by in the room
+func (c *client) nickname(room *chatroom) string {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	if room.nickname != "" {
+		return room.nickname
+	}
+	return c.defaultNickname
+}
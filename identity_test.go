@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// newMember is a client with an identity, and the node ID that goes with it
+func newMember(t *testing.T) *client {
+	c := newClient()
+	var err error
+	if c.privateKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if c.identity, err = x509.MarshalPKIXPublicKey(&c.privateKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	c.Node.ID = nodeIDOf(c.identity)
+	c.defaultNickname = DEFAULT_NICKNAME
+	return c
+}
+
+func newIdentity(t *testing.T) []byte {
+	return newMember(t).identity
+}
+
+// a node ID only goes with the identity it's made from
+func TestIdentityGoesWithNodeID(t *testing.T) {
+	room := newChatroom("room", nil, nil, nil)
+	alice, mallory := newIdentity(t), newIdentity(t)
+	a := string(nodeIDOf(alice))
+
+	if err := room.bindIdentity(a, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.bindIdentity(a, alice); err != nil {
+		t.Errorf("the same identity again should be fine. Got %s", err)
+	}
+	if err := room.bindIdentity(a, mallory); err != errIdentityMismatch {
+		t.Errorf("expected %q. Got %v", errIdentityMismatch, err)
+	}
+	if err := room.bindIdentity("m", []byte("not a key")); err == nil {
+		t.Error("garbage shouldn't be bound")
+	}
+
+	pub, _ := parseIdentity(alice)
+	if !room.publicKeys[a].Equal(pub) {
+		t.Error("a's identity was overwritten")
+	}
+}
+
+// mallory is a member of the room, and puts alice's node ID on her messages before alice has said anything. They're
+// dropped, and don't leave anything of mallory's for a rekey to seal alice's new keys to
+func TestNoOneCanSendAsSomeoneElse(t *testing.T) {
+	room := createChatroom()
+	alice, mallory := newMember(t), newMember(t)
+
+	// with her own identity
+	msg, err := mallory.newControl(room, AckMessage, ackBody{"x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Sender = string(alice.Node.ID)
+	if msg, err = mallory.secure(room, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := room.authenticate(msg); err != errIdentityMismatch {
+		t.Errorf("expected %q. Got %v", errIdentityMismatch, err)
+	}
+
+	// with alice's, which she can't sign for
+	msg, _ = mallory.newControl(room, AckMessage, ackBody{"x"})
+	msg.Sender, msg.Identity = string(alice.Node.ID), alice.identity
+	if msg, err = mallory.secure(room, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := room.authenticate(msg); err != errBadIdentity {
+		t.Errorf("expected %q. Got %v", errBadIdentity, err)
+	}
+
+	room.lock.Lock()
+	_, bound := room.publicKeys[string(alice.Node.ID)]
+	room.lock.Unlock()
+	if bound {
+		t.Fatal("an identity was bound to alice's node ID")
+	}
+
+	// alice herself is fine, and hers is the key that's remembered
+	msg, _ = alice.newControl(room, AckMessage, ackBody{"x"})
+	if msg, err = alice.secure(room, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := room.authenticate(msg); err != nil {
+		t.Fatal(err)
+	}
+	room.lock.Lock()
+	pub := room.publicKeys[string(alice.Node.ID)]
+	room.lock.Unlock()
+	if !pub.Equal(&alice.privateKey.PublicKey) {
+		t.Error("alice's node ID isn't bound to her identity")
+	}
+}
+
+// who a message is from only goes out sealed. Members get it back when they open it
+func TestIdentityIsSealed(t *testing.T) {
+	room := createChatroom()
+	alice := newMember(t)
+	alice.defaultNickname = "alice the sender"
+
+	msg, _ := alice.newControl(room, AckMessage, ackBody{"x"})
+	msg, err := alice.secure(room, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := msgpack.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for what, revealing := range map[string][]byte{"nickname": []byte(alice.defaultNickname), "identity": alice.identity} {
+		if bytes.Contains(b, revealing) {
+			t.Errorf("the %s goes out in the clear", what)
+		}
+	}
+
+	var received Message
+	if err := msgpack.Unmarshal(b, &received); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := room.authenticate(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Nickname != alice.defaultNickname || !bytes.Equal(opened.Identity, alice.identity) {
+		t.Errorf("expected the message to be from alice. Got %s", displayName(opened))
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/agl/pond/bbssig"
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack"
+)
+
+// roles: the room's creator is its manager, and is the only one with the group private key - which is what makes new
+// member keys, and opens signatures. Everyone else is just a member: they get the group public key and a member key with
+// their invite, and are never sent the group private key.
+//
+// A member who wants to invite someone asks the managers that are online. The request goes out like any other room
+// message, and sits with each manager until they approve or deny it. An approved invite is encrypted to the requester's
+// identity key, and written out to their invites/, same as if they'd made it themselves.
+//
+// Who the managers are comes with the invite (<roomID>_managers.pem), as their identity keys. It's not something to be
+// told by whoever lets us in: anyone they named as a manager would be asked for invites, and have their rekeys taken.
+// So whoever joins only ever takes on the managers their invite named
+var (
+	errNotManager     = errors.New("only managers can do that")
+	errNoManagers     = errors.New("none of the room's managers are participants right now")
+	errUnknownManager = errors.New("names a manager the invite doesn't")
+)
+
+type inviteRequest struct {
+	IssuedTo string // who the invite is for
+}
+
+type inviteReply struct {
+	RequestID string
+	Approved  bool
+	Sealed    []byte // the sealed invite, encrypted to the requester's identity. See sealTo
+}
+
+type invite struct {
+	GroupPublicKey []byte
+	MemberKey      []byte
+	RoomKey        []byte
+	Managers       [][]byte // identities
+}
+
+// pendingInvite is an invite request waiting on the user to approve or deny it
+type pendingInvite struct {
+	room    *chatroom
+	request Message
+}
+
+// manager says whether we're a manager of the room
+func (room *chatroom) manager() bool {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	return room.groupPrivateKey != nil
+}
+
+func (room *chatroom) isManager(participant string) bool {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	_, ok := room.managers[participant]
+	return ok
+}
+
+// fromManager says whether the message is from a manager - it has to carry the identity the manager had when we were
+// told of them, otherwise anyone could put a manager's node ID on their message
+func (room *chatroom) fromManager(msg Message) bool {
+	return room.isManagerWith(msg.Sender, msg.Identity)
+}
+
+// isManagerWith says whether the participant is a manager, with that identity
+func (room *chatroom) isManagerWith(participant string, identity []byte) bool {
+	pub, err := parseIdentity(identity)
+	if err != nil {
+		return false
+	}
+
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	manager, ok := room.managers[participant]
+	return ok && manager.Equal(pub)
+}
+
+// checkManagers checks that the managers we've been told of are all ones we already know of, with the same identities.
+// See the top of the file
+func (room *chatroom) checkManagers(managers map[string][]byte) error {
+	for manager, identity := range managers {
+		if !room.isManagerWith(manager, identity) {
+			return errUnknownManager
+		}
+	}
+	return nil
+}
+
+// addManager takes on a manager of the room, along with their identity. See bindIdentity
+func (room *chatroom) addManager(participant string, identity []byte) error {
+	if err := room.bindIdentity(participant, identity); err != nil {
+		return err
+	}
+	pub, _ := parseIdentity(identity)
+
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	room.managers[participant] = pub
+	return nil
+}
+
+// Managers returns the room's managers: node ID -> public key
+func (room *chatroom) Managers() map[string][]byte {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	retVal := make(map[string][]byte)
+	for manager, pub := range room.managers {
+		if identity, err := x509.MarshalPKIXPublicKey(pub); err == nil {
+			retVal[manager] = identity
+		}
+	}
+	return retVal
+}
+
+// managerIdentities returns the identities of the room's managers, in order, as they go in invites
+func (room *chatroom) managerIdentities() [][]byte {
+	var retVal [][]byte
+	for _, identity := range room.Managers() {
+		retVal = append(retVal, identity)
+	}
+	sort.Slice(retVal, func(i, j int) bool { return bytes.Compare(retVal[i], retVal[j]) < 0 })
+	return retVal
+}
+
+func writeManagers(filename string, managers [][]byte) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, identity := range managers {
+		if err := pem.Encode(f, &pem.Block{Type: "MANAGER IDENTITY", Bytes: identity}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readManagers reads the managers' identities back. There has to be at least one
+func readManagers(filename string) ([][]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var managers [][]byte
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		if block.Type != "MANAGER IDENTITY" {
+			return nil, fmt.Errorf("incorrect pem type in %s. Expected MANAGER IDENTITY", filename)
+		}
+		if _, err := parseIdentity(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%s has something that isn't an identity in it", filename)
+		}
+		managers = append(managers, block.Bytes)
+	}
+	if len(managers) == 0 {
+		return nil, fmt.Errorf("%s has no managers in it", filename)
+	}
+	return managers, nil
+}
+
+// handle marks the message with the ID as dealt with. False is returned if it had already been
+func (room *chatroom) handle(id string) bool {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	if room.handled[id] {
+		return false
+	}
+	room.handled[id] = true
+	return true
+}
+
+func (room *chatroom) handledAlready(id string) bool {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	return room.handled[id]
+}
+
+// mintMember makes a new member key, and writes down who it was for
+func (room *chatroom) mintMember(issuedTo string) (*bbssig.MemberKey, error) {
+	if !room.manager() {
+		return nil, errNotManager
+	}
+
+	newMember, err := room.groupPrivateKey.NewMember(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := room.registerMember(newMember.Tag(), issuedTo); err != nil {
+		log.Printf("Unable to write down who the invite to %s is for. Error was: %s", room.ID, err)
+	}
+	return newMember, nil
+}
+
+// newControl makes a message that isn't chat - it doesn't get a sequence number, and doesn't go in the log
+func (c *client) newControl(room *chatroom, t MessageType, body interface{}) (Message, error) {
+	b, err := msgpack.Marshal(body)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		Type:        t,
+		Destination: room.ID,
+		Message:     b,
+
+		ID:       uuid.New().String(),
+		Sender:   string(c.Node.ID),
+		Nickname: c.nickname(room),
+		Identity: c.identity,
+	}, nil
+}
+
+// secure signs the message with our identity, seals it - text with our sender key, everything else with the room key - and
+// signs it with our member key. See authenticate for the other end
+func (c *client) secure(room *chatroom, msg Message) (Message, error) {
+	msg, err := signIdentity(msg, c.privateKey)
+	if err != nil {
+		return msg, err
+	}
+	if msg.Type == TextMessage {
+		msg, err = room.sealText(msg)
+	} else {
+		msg, err = room.seal(msg)
+	}
+	if err != nil {
+		return msg, err
+	}
+	return room.sign(msg)
+}
+
+// RequestInvite asks the room's managers for an invite
+func (c *client) RequestInvite(room *chatroom, issuedTo string) error {
+	msg, err := c.newControl(room, InviteRequestMessage, inviteRequest{issuedTo})
+	if err != nil {
+		return err
+	}
+	if msg, err = c.secure(room, msg); err != nil {
+		return err
+	}
+
+	var asked int
+	for participant, address := range room.Participants() {
+		if participant != string(c.Node.ID) && room.isManager(participant) {
+			go c.sendReliably(participant, address, msg)
+			asked++
+		}
+	}
+	if asked == 0 {
+		return errNoManagers
+	}
+	c.ui <- fmt.Sprintf("...Asked %d managers of %s for an invite. Request ID: %s", asked, room.Name, msg.ID)
+	return nil
+}
+
+// inviteRequested holds on to an invite request until the user approves or denies it
+func (c *client) inviteRequested(room *chatroom, msg Message) {
+	if !room.manager() {
+		return // not for us
+	}
+
+	var req inviteRequest
+	if err := msgpack.Unmarshal(msg.Message, &req); err != nil {
+		log.Printf("Unable to unmarshal invite request %s: %s", msg.ID, err)
+		return
+	}
+
+	c.inviteLock.Lock()
+	c.inviteRequests[msg.ID] = pendingInvite{room, msg}
+	c.inviteLock.Unlock()
+
+	c.ui <- fmt.Sprintf("...%s asks for an invite to %s, for %q. Use approve or deny with the request ID: %s", displayName(msg), room.Name, req.IssuedTo, msg.ID)
+}
+
+// AnswerInvite approves or denies an invite request
+func (c *client) AnswerInvite(requestID string, approved bool) error {
+	c.inviteLock.Lock()
+	pending, ok := c.inviteRequests[requestID]
+	delete(c.inviteRequests, requestID)
+	c.inviteLock.Unlock()
+	if !ok {
+		return fmt.Errorf("no invite request %s", requestID)
+	}
+	room, request := pending.room, pending.request
+
+	reply := inviteReply{RequestID: requestID, Approved: approved}
+	if approved {
+		var req inviteRequest
+		msgpack.Unmarshal(request.Message, &req)
+
+		newMember, err := room.mintMember(fmt.Sprintf("%s, asked for by %s", req.IssuedTo, displayName(request)))
+		if err != nil {
+			return err
+		}
+		b, err := msgpack.Marshal(invite{room.groupPublicKey.Marshal(), newMember.Marshal(), room.roomKey, room.managerIdentities()})
+		if err != nil {
+			return err
+		}
+		pub, err := parseIdentity(request.Identity)
+		if err != nil {
+			return err
+		}
+		if reply.Sealed, err = sealTo(pub, b); err != nil {
+			return err
+		}
+	}
+
+	msg, err := c.newControl(room, InviteReplyMessage, reply)
+	if err != nil {
+		return err
+	}
+	if msg, err = c.secure(room, msg); err != nil {
+		return err
+	}
+
+	address, ok := room.participant(request.Sender)
+	if !ok {
+		return fmt.Errorf("%s is no longer in %s", displayName(request), room.Name)
+	}
+	go c.sendReliably(request.Sender, address, msg)
+	return nil
+}
+
+// inviteReplied writes out an approved invite
+func (c *client) inviteReplied(room *chatroom, msg Message) error {
+	if !room.fromManager(msg) {
+		return errNotManager
+	}
+
+	var reply inviteReply
+	if err := msgpack.Unmarshal(msg.Message, &reply); err != nil {
+		return err
+	}
+	if !reply.Approved {
+		c.ui <- fmt.Sprintf("...%s denied invite request %s", displayName(msg), reply.RequestID)
+		return nil
+	}
+
+	b, err := openWith(c.privateKey, reply.Sealed)
+	if err != nil {
+		return err
+	}
+	var inv invite
+	if err := msgpack.Unmarshal(b, &inv); err != nil {
+		return err
+	}
+	group, ok := room.groupPublicKey.Unmarshal(inv.GroupPublicKey)
+	if !ok {
+		return errors.New("unable to unmarshal the group public key")
+	}
+	member, ok := room.memberPrivateKey.Unmarshal(group, inv.MemberKey)
+	if !ok {
+		return errors.New("unable to unmarshal the member key")
+	}
+	if len(inv.RoomKey) != ROOM_KEY_SIZE {
+		return fmt.Errorf("room key is %d bytes. Expected %d", len(inv.RoomKey), ROOM_KEY_SIZE)
+	}
+	if len(inv.Managers) == 0 {
+		return errors.New("the invite doesn't say who the managers are")
+	}
+
+	writeInvite(room.ID, group, member, inv.RoomKey, inv.Managers)
+	c.ui <- fmt.Sprintf("...%s approved invite request %s. The invite is in invites/", displayName(msg), reply.RequestID)
+	return nil
+}
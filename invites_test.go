@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// a member can put a manager's node ID on their message, but not the manager's identity
+func TestOnlyManagersAreManagers(t *testing.T) {
+	room := newChatroom("room", nil, nil, nil)
+	manager, member := newIdentity(t), newIdentity(t)
+	m := string(nodeIDOf(manager))
+
+	if err := room.addManager(m, manager); err != nil {
+		t.Fatal(err)
+	}
+	if !room.fromManager(Message{Sender: m, Identity: manager}) {
+		t.Error("the manager should be a manager")
+	}
+	if room.fromManager(Message{Sender: m, Identity: member}) {
+		t.Error("a member claiming to be the manager shouldn't be")
+	}
+	if room.fromManager(Message{Sender: string(nodeIDOf(member)), Identity: manager}) {
+		t.Error("the manager's identity on another node ID shouldn't be a manager")
+	}
+	if err := room.addManager(string(nodeIDOf(member)), manager); err != errIdentityMismatch {
+		t.Errorf("the manager's identity shouldn't go with anyone else's node ID. Got %v", err)
+	}
+}
+
+// whoever lets us in can only tell us of the managers our invite named
+func TestManagersComeWithTheInvite(t *testing.T) {
+	room := newChatroom("room", nil, nil, nil)
+	manager, member := newIdentity(t), newIdentity(t)
+	m := string(nodeIDOf(manager))
+	if err := room.addManager(m, manager); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := room.checkManagers(map[string][]byte{m: manager}); err != nil {
+		t.Errorf("the invite's manager should check out. Got %v", err)
+	}
+	if err := room.checkManagers(map[string][]byte{m: manager, string(nodeIDOf(member)): member}); err != errUnknownManager {
+		t.Errorf("a manager the invite didn't name should be refused. Got %v", err)
+	}
+	if err := room.checkManagers(map[string][]byte{m: member}); err != errUnknownManager {
+		t.Errorf("the manager's node ID with someone else's identity should be refused. Got %v", err)
+	}
+	if len(room.Managers()) != 1 {
+		t.Error("checking took on a manager")
+	}
+}
+
+// the managers go out with an invite, and come back the same
+func TestManagersFile(t *testing.T) {
+	a, b := newIdentity(t), newIdentity(t)
+	filename := filepath.Join(t.TempDir(), "managers.pem")
+
+	if err := writeManagers(filename, [][]byte{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	managers, err := readManagers(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(managers) != 2 || !bytes.Equal(managers[0], a) || !bytes.Equal(managers[1], b) {
+		t.Error("the managers didn't come back the same")
+	}
+
+	if err := writeManagers(filename, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readManagers(filename); err == nil {
+		t.Error("an invite without managers should be refused")
+	}
+}
@@ -0,0 +1,66 @@
+package kademlia
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+)
+
+// Bootstrap joins the network through the seeds, which are host:port addresses. Seeds that don't resolve are skipped.
+// It returns how many seeds responded, and how many contacts the routing table ended up with
+func (dht *Kademlia) Bootstrap(ctx context.Context, seeds []string) (responded, contacts int) {
+	var addrs []*net.UDPAddr
+	for _, seed := range seeds {
+		addr, err := net.ResolveUDPAddr("udp", seed)
+		if err != nil {
+			log.Printf("Unable to resolve seed %s. Error was: %s", seed, err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+
+	responded = dht.bootstrap(ctx, addrs)
+	return responded, len(dht.Node.Contacts())
+}
+
+// bootstrap is the actual bootstrapping, as per the paper: ping all the seeds at once, so the ones that respond go into
+// the routing table, then look ourselves up to find our neighbours. Lastly, every bucket farther away than the closest
+// neighbour is refreshed, which fills up the rest of the routing table.
+// The number of seeds that responded is returned
+func (dht *Kademlia) bootstrap(ctx context.Context, addrs []*net.UDPAddr) int {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	responded := 0
+
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			if call := <-dht.PingIP(ctx, addr).Done; call.Error == nil {
+				lock.Lock()
+				responded++
+				lock.Unlock()
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	if responded == 0 {
+		return 0
+	}
+
+	dht.FindNode(ctx, dht.Node.ID)
+
+	closest := dht.Node.GetNClosestNodes(dht.Node.ID, 1)
+	if len(closest) == 0 {
+		return responded
+	}
+	for bucketID := dht.Node.ID.DistanceTo(closest[0].ID).GetBucketID() + 1; bucketID < ID_SIZE*8; bucketID++ {
+		if ctx.Err() != nil {
+			break
+		}
+		dht.FindNode(ctx, dht.Node.RandomIDInBucket(bucketID))
+	}
+	return responded
+}
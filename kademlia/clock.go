@@ -0,0 +1,38 @@
+package kademlia
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is where the kademlia package gets the time from, for everything that ages: contacts, buckets, records, peers and tokens.
+// It's the wall clock unless SetClock is called. Timeouts and the tickers in Run always go by the wall clock
+type Clock interface {
+	Now() time.Time
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time { return time.Now() }
+
+var (
+	clock     Clock = wallClock{}
+	clockLock sync.RWMutex
+)
+
+// SetClock replaces the clock of the whole package, and returns the one it replaced. It's meant to be called before any
+// node is created - nodes that are still running (say, ones being shut down) go by the new clock from then on
+func SetClock(c Clock) (previous Clock) {
+	clockLock.Lock()
+	defer clockLock.Unlock()
+	previous, clock = clock, c
+	return previous
+}
+
+func now() time.Time {
+	clockLock.RLock()
+	defer clockLock.RUnlock()
+	return clock.Now()
+}
+
+func since(t time.Time) time.Duration { return now().Sub(t) }
@@ -1,34 +1,51 @@
 package kademlia
 
 import (
+	"context"
 	"net"
+	"sync"
 	"time"
 
-	"fmt"
 	"log"
 
 	"github.com/vmihailenco/msgpack"
 )
 
+// Kademlia is safe for concurrent use. All the bookkeeping maps are guarded by lock, and are only to be accessed
+// through the methods. The routing table and store belong to Node, which has its own lock.
+// Handlers are run in their own goroutines, so they must not assume anything about ordering
 type Kademlia struct {
-	Node       *Node
-	Name       string // this is used as the chatroom ID
-	Connection *net.UDPConn
+	Node      *Node
+	Name      string    // this is used as the chatroom ID
+	Transport Transport // if this isn't set before Listen or Run, a framed UDP transport on Node.Port is used
 
 	packets  chan packet
 	requests chan Message
 	kill     chan bool
 
-	ResponseHandler map[string]ResponseFunc
+	responseHandler map[string]ResponseFunc
+	replyTypes      map[string][]string // request type -> the message types that answer it. See Expect
 
-	AwaitingResponse map[string]time.Time   // key is token - req/rep method
-	ExtraInfo        map[string]interface{} // key is token. This is a store of random things that may be needed
+	awaitingResponse map[string]time.Time   // key is token - req/rep method
+	extraInfo        map[string]interface{} // key is token. This is a store of random things that may be needed
 
 	pendingQueries   map[string]time.Time   // key is token - this represents a queue of sorts for work
 	pendingEnvelopes map[string]*RemoteNode // key is token - this is for all the return addresses
 
-	ResultChan map[string]chan interface{} // key is token
+	calls    map[string]*Call // key is token - these are the outstanding requests made with Go()
+	orphans  map[string]bool  // tokens found to be garbage on the last sweep
+	evicting map[string]bool  // key is node ID - stale nodes that are being pinged to see if they should be evicted
 
+	secrets   secrets        // for the write tokens handed out in GET_PEERS. This has its own lock
+	announced map[string]int // key -> port. These are our own announcements, which get redone every so often
+
+	lock sync.Mutex
+
+	Alpha   int           // number of concurrent queries during a lookup
+	Timeout time.Duration // how long to wait for a response before resending a request
+	Retries int           // how many times a request is resent before giving up
+
+	StateFile string // if set, the node ID and routing table are saved here every maintenance run
 }
 
 func NewKademlia() *Kademlia {
@@ -39,18 +56,24 @@ func NewKademlia() *Kademlia {
 		requests: make(chan Message),
 		kill:     make(chan bool),
 
-		ResponseHandler: make(map[string]ResponseFunc),
-
-		AwaitingResponse: make(map[string]time.Time),
-		ExtraInfo:        make(map[string]interface{}),
+		awaitingResponse: make(map[string]time.Time),
+		extraInfo:        make(map[string]interface{}),
 
 		pendingQueries:   make(map[string]time.Time),
 		pendingEnvelopes: make(map[string]*RemoteNode),
 
-		ResultChan: make(map[string]chan interface{}),
+		calls:    make(map[string]*Call),
+		orphans:  make(map[string]bool),
+		evicting: make(map[string]bool),
+
+		announced: make(map[string]int),
+
+		Alpha:   ALPHA,
+		Timeout: RPC_TIMEOUT,
+		Retries: RPC_RETRIES,
 	}
 
-	k.ResponseHandler = map[string]ResponseFunc{
+	k.responseHandler = map[string]ResponseFunc{
 		"PING":                k.pong,
 		"PONG":                k.pongResponse,
 		"FIND_NODE":           k.findNodeResponse,
@@ -59,6 +82,14 @@ func NewKademlia() *Kademlia {
 		"STORE_RESPONSE":      k.storeResponseHandler,
 		"FIND_VALUE":          k.findValueResponse,
 		"FIND_VALUE_RESPONSE": k.findValueResponseHandler,
+
+		"GET_PEERS":              k.getPeersResponse,
+		"GET_PEERS_RESPONSE":     k.getPeersResponseHandler,
+		"ANNOUNCE_PEER":          k.announcePeerResponse,
+		"ANNOUNCE_PEER_RESPONSE": k.announcePeerResponseHandler,
+	}
+	k.replyTypes = map[string][]string{
+		"PING": {"PONG"},
 	}
 
 	return k
@@ -68,47 +99,173 @@ func (dht *Kademlia) Run() {
 	// start server
 	// bootstrap network
 	// listen for DHT messages
-	if dht.Connection == nil {
-		dht.initNetwork()
-	}
+	dht.Listen()
 
 	go dht.readFromSocket()
 	go dht.processPackets()
 	go dht.handleMessages()
+
+	sweeper := time.NewTicker(SWEEP_INTERVAL)
+	defer sweeper.Stop()
+	maintenance := time.NewTicker(MAINTENANCE_INTERVAL)
+	defer maintenance.Stop()
+	rotate := time.NewTicker(SECRET_ROTATE_INTERVAL)
+	defer rotate.Stop()
+	reannounce := time.NewTicker(REANNOUNCE_INTERVAL)
+	defer reannounce.Stop()
 	for {
 		select {
 		case <-dht.kill:
 			return
-		default:
-			continue
+		case <-sweeper.C:
+			dht.sweep()
+		case <-maintenance.C:
+			go dht.Maintain()
+		case <-rotate.C:
+			dht.secrets.rotate()
+		case <-reannounce.C:
+			go dht.Reannounce()
 		}
 	}
+}
 
+// Listen opens the UDP socket, if there isn't a transport yet. Run does this anyway, but anything that wants to send
+// before Run gets going (pinging saved contacts on start, for instance) has to call it first
+func (dht *Kademlia) Listen() {
+	dht.lock.Lock()
+	defer dht.lock.Unlock()
+	if dht.Transport == nil {
+		dht.initNetwork()
+	}
+}
+
+// Close stops Run and closes the transport
+func (dht *Kademlia) Close() error {
+	dht.lock.Lock()
+	select {
+	case <-dht.kill:
+		dht.lock.Unlock()
+		return nil // already closed
+	default:
+		close(dht.kill)
+	}
+	dht.lock.Unlock()
+
+	if dht.Transport == nil {
+		return nil
+	}
+	return dht.Transport.Close()
 }
 
 type ResponseFunc func(*RemoteNode, string, NodeID, interface{})
 
-func (dht *Kademlia) Ping(remote *RemoteNode) string {
-	message, token := NewMessage()
-	message.MessageType = "PING"
-	message.SourceID = dht.Node.ID
+// Handle registers a handler for a message type. This is how new query types are added
+func (dht *Kademlia) Handle(messageType string, f ResponseFunc) {
+	dht.lock.Lock()
+	dht.responseHandler[messageType] = f
+	dht.lock.Unlock()
+}
+
+// Expect registers the message types that answer a request type, so a call made with Go is only completed by one of
+// them. Request types that aren't registered are answered by the same type with _RESPONSE on the end
+func (dht *Kademlia) Expect(requestType string, replyTypes ...string) {
+	dht.lock.Lock()
+	dht.replyTypes[requestType] = replyTypes
+	dht.lock.Unlock()
+}
+
+// answers says whether a message of the reply type answers the request type. It's called with the lock held
+func (dht *Kademlia) answers(requestType, replyType string) bool {
+	types, ok := dht.replyTypes[requestType]
+	if !ok {
+		return replyType == requestType+"_RESPONSE"
+	}
+	for _, t := range types {
+		if t == replyType {
+			return true
+		}
+	}
+	return false
+}
+
+// SetExtraInfo registers additional data with a token, for the handlers of the responses to use
+func (dht *Kademlia) SetExtraInfo(token string, info interface{}) {
+	dht.lock.Lock()
+	dht.extraInfo[token] = info
+	dht.lock.Unlock()
+}
+
+func (dht *Kademlia) GetExtraInfo(token string) (info interface{}, ok bool) {
+	dht.lock.Lock()
+	info, ok = dht.extraInfo[token]
+	dht.lock.Unlock()
+	return
+}
 
-	SendMsg(dht.Connection, remote.Address, message)
+// TakeExtraInfo gets the data registered with a token and clears it, so whatever's registered can only be had once
+func (dht *Kademlia) TakeExtraInfo(token string) (info interface{}, ok bool) {
+	dht.lock.Lock()
+	info, ok = dht.extraInfo[token]
+	delete(dht.extraInfo, token)
+	dht.lock.Unlock()
+	return
+}
 
-	// register token with AwaitingResponse
-	dht.AwaitingResponse[token] = time.Now()
-	return token
+// Forget clears everything registered with a token. Call this once an exchange is over
+func (dht *Kademlia) Forget(token string) {
+	dht.lock.Lock()
+	delete(dht.awaitingResponse, token)
+	delete(dht.extraInfo, token)
+	dht.lock.Unlock()
 }
 
-func (dht *Kademlia) PingIP(addr *net.UDPAddr) string {
-	message, token := NewMessage()
+// AwaitingResponse returns a snapshot of the tokens waiting for a response, and when they started waiting
+func (dht *Kademlia) AwaitingResponse() map[string]time.Time {
+	dht.lock.Lock()
+	defer dht.lock.Unlock()
+
+	retVal := make(map[string]time.Time, len(dht.awaitingResponse))
+	for k, v := range dht.awaitingResponse {
+		retVal[k] = v
+	}
+	return retVal
+}
+
+func (dht *Kademlia) Ping(ctx context.Context, remote *RemoteNode) *Call {
+	return dht.PingIP(ctx, remote.Address)
+}
+
+func (dht *Kademlia) PingIP(ctx context.Context, addr *net.UDPAddr) *Call {
+	message, _ := NewMessage()
 	message.MessageType = "PING"
 	message.SourceID = dht.Node.ID
 
-	SendMsg(dht.Connection, addr, message)
+	return dht.Go(ctx, addr, message)
+}
 
-	dht.AwaitingResponse[token] = time.Now()
-	return token
+// evict pings the least recently seen node of a full bucket. If it responds, it's moved to the front of the bucket as usual.
+// If it doesn't, it's deleted from the routing table, and the node in the replacement cache takes its place.
+// Long lived nodes are more likely to stay alive, so they're never thrown out just because a new one showed up
+func (dht *Kademlia) evict(stale *RemoteNode) {
+	dht.lock.Lock()
+	if dht.evicting[string(stale.ID)] {
+		dht.lock.Unlock()
+		return // already being checked on
+	}
+	dht.evicting[string(stale.ID)] = true
+	dht.lock.Unlock()
+
+	defer func() {
+		dht.lock.Lock()
+		delete(dht.evicting, string(stale.ID))
+		dht.lock.Unlock()
+	}()
+
+	call := <-dht.Ping(context.Background(), stale).Done
+	if call.Error != nil {
+		log.Printf("Evicting %s: %s", stale.Address, call.Error)
+		dht.Node.Delete(stale)
+	}
 }
 
 func (dht *Kademlia) pong(remote *RemoteNode, token string, source NodeID, data interface{}) {
@@ -117,83 +274,83 @@ func (dht *Kademlia) pong(remote *RemoteNode, token string, source NodeID, data
 	message.SourceID = dht.Node.ID
 	message.Token = token
 
-	SendMsg(dht.Connection, remote.Address, message)
+	SendMsg(dht.Transport, remote.Address, message)
 }
 
 func (dht *Kademlia) pongResponse(remote *RemoteNode, token string, source NodeID, data interface{}) {
-	defer delete(dht.AwaitingResponse, token)
-
-	remote.lastResponded = time.Now()
-	dht.Node.AddressToNode[remote.Address.String()] = remote // store it in the index
+	remote.touch()
 }
 
-//LocalStore basically stores data in the local node
-func (dht *Kademlia) LocalStore(key string, value interface{}) {
-	dht.Node.Store[key] = value
+// Store stores the value at the remote, with this node as the publisher
+func (dht *Kademlia) Store(ctx context.Context, remote *RemoteNode, key string, value interface{}) *Call {
+	return dht.storeRecord(ctx, remote, record{Key: key, Value: value, Publisher: dht.Node.ID, Published: now()})
 }
 
-func (dht *Kademlia) Store(remote *RemoteNode, key string, value interface{}) string {
-	msg := map[string]interface{}{key: value}
-
-	message, token := NewMessage()
+func (dht *Kademlia) storeRecord(ctx context.Context, remote *RemoteNode, r record) *Call {
+	message, _ := NewMessage()
 	message.MessageType = "STORE"
 	message.SourceID = dht.Node.ID
-	message.InsertMessage(msg)
+	message.InsertMessage(r)
 
-	SendMsg(dht.Connection, remote.Address, message)
-	dht.AwaitingResponse[token] = time.Now()
-	return token
+	return dht.Go(ctx, remote.Address, message)
 }
 
 func (dht *Kademlia) storeResponse(remote *RemoteNode, token string, source NodeID, data interface{}) {
-	p, _ := data.(string)
-	byteArrayP := []byte(p)
+	p, _ := Payload(data)
 
-	var m map[string]interface{}
-	msgpack.Unmarshal(byteArrayP, &m)
-
-	for k, v := range m {
-		dht.LocalStore(k, v)
+	var r record
+	if err := msgpack.Unmarshal(p, &r); err != nil {
+		log.Printf("Unable to unmarshal STORE. Error was: %s", err)
+		return
+	}
+	if r.Key == "" || len(r.Publisher) != ID_SIZE || r.expired() {
+		log.Printf("DISCARDED STORE of %q from %s", r.Key, remote.Address)
+		return
+	}
+	if r.Publisher.EqualsTo(dht.Node.ID) {
+		// only we publish our own records. Taking one in would have us republishing it forever
+		log.Printf("DISCARDED STORE of %q from %s, claiming to be published by us", r.Key, remote.Address)
+		return
+	}
+	if r.Publisher.EqualsTo(remote.ID) {
+		r.Address = remote.Address // the provider is wherever its announcement came from, not wherever it says it is
+		dht.Node.putRecord(r)
+	} else {
+		dht.Node.putReplica(r)
 	}
 
 	message, _ := NewMessage()
 	message.MessageType = "STORE_RESPONSE"
 	message.SourceID = dht.Node.ID
 	message.Message = "OK"
+	message.Token = token
 
-	SendMsg(dht.Connection, remote.Address, message)
+	SendMsg(dht.Transport, remote.Address, message)
 }
 
 func (dht *Kademlia) storeResponseHandler(remote *RemoteNode, token string, source NodeID, data interface{}) {
-	defer delete(dht.AwaitingResponse, token)
-	remote.lastResponded = time.Now()
+	remote.touch()
 }
 
-func (dht *Kademlia) FindNode(remote *RemoteNode, cmp NodeID) string {
-	message, token := NewMessage()
+// findNode sends a single FIND_NODE query. Use FindNode for the full iterative lookup
+func (dht *Kademlia) findNode(ctx context.Context, remote *RemoteNode, target NodeID) *Call {
+	message, _ := NewMessage()
 	message.MessageType = "FIND_NODE"
 	message.SourceID = dht.Node.ID
-	message.Message = cmp
-
-	SendMsg(dht.Connection, remote.Address, message)
-	// register awaiting response with token
-	dht.AwaitingResponse[token] = time.Now()
-	// register additional data with token
-	dht.ExtraInfo[token] = cmp
-	// register a channel
-	dht.ResultChan[token] = make(chan interface{})
+	message.Message = target
 
-	return token
+	return dht.Go(ctx, remote.Address, message)
 }
 
 func (dht *Kademlia) findNodeResponse(remote *RemoteNode, token string, source NodeID, data interface{}) {
-	t, ok := data.(string)
-	if !ok {
-		panic(fmt.Sprintf("SHIT. params is %T | %#v\n", data, data))
+	t, ok := Payload(data)
+	if !ok || len(t) != ID_SIZE {
+		log.Printf("DISCARDED FIND_NODE from %s. params is %T", remote.Address, data)
+		return
 	}
 
 	target := NodeID(t)
-	closestNodes := dht.Node.GetNClosestNodes(target, 8)
+	closestNodes := dht.Node.GetNClosestNodes(target, K)
 
 	message, _ := NewMessage()
 	message.MessageType = "FIND_NODE_RESPONSE"
@@ -202,194 +359,142 @@ func (dht *Kademlia) findNodeResponse(remote *RemoteNode, token string, source N
 	// replace the autogenerated token  with the received token so the sender knows which message this is replying to
 	message.Token = token
 
-	SendMsg(dht.Connection, remote.Address, message)
+	SendMsg(dht.Transport, remote.Address, message)
 }
 
+// the actual nodes are handled by the lookup that made the call
 func (dht *Kademlia) findNodeResponseHandler(remote *RemoteNode, token string, source NodeID, data interface{}) {
-	defer delete(dht.AwaitingResponse, token)
-	defer delete(dht.ExtraInfo, token)
-	defer func() { remote.lastResponded = time.Now() }()
-
-	// handle the data received
-	p, _ := data.(string)
-	byteArrayT := []byte(p)
-	var remoteNodes []*RemoteNode
-	msgpack.Unmarshal(byteArrayT, &remoteNodes)
-
-	t, ok := dht.ExtraInfo[token]
-	if !ok {
-		// do something
-		panic("Nothing found in ExtraInfo. Weird")
-	}
-
-	target, ok := t.(NodeID)
-	if !ok {
-		panic(fmt.Sprintf("t is supposed to be a NodeID. It is %T instead", t))
-	}
-
-	// here we use a simple trick - not scalable for larger scale DHTs, but for small networks it works well
-	// basically it looks for the remote nodes that this node already knows about.
-	// the problem starts coming in when you have more than 160 nodes I guess.
-	var unseen []*RemoteNode = make([]*RemoteNode, 0)
-	for _, r := range remoteNodes {
-		if string(r.ID) == string(dht.Node.ID) {
-			continue // skip anything that is itself
-		}
-
-		//check if node already exists. If not, send a new message with the target in mind
-		_, seen := dht.Node.AddressToNode[r.Address.String()]
-
-		if !seen {
-			unseen = append(unseen, r)
-		}
-
-		if string(r.ID) == string(target) {
-			ch, ok := dht.ResultChan[token]
-			if !ok {
-				panic("No Result chan available to send the resulting node to chan")
-			}
-			ch <- r
-
-			return // bailout
-		}
-	}
-
-	for _, remote := range unseen {
-		dht.FindNode(remote, target)
-	}
-	log.Println("Done with Find Node Response Handler")
-	return
+	remote.touch()
+}
 
+// valueResponse is what a FIND_VALUE gets back: every provider of the key that the remote knows of.
+// If there are none, the closest nodes to the key are sent instead
+type valueResponse struct {
+	Found   bool
+	Records []record
+	Nodes   []*RemoteNode
 }
 
-func (dht *Kademlia) FindValue(remote *RemoteNode, key string) string {
-	message, token := NewMessage()
+// findValue sends a single FIND_VALUE query. Use FindValue for the full iterative lookup
+func (dht *Kademlia) findValue(ctx context.Context, remote *RemoteNode, key string) *Call {
+	message, _ := NewMessage()
 	message.MessageType = "FIND_VALUE"
 	message.SourceID = dht.Node.ID
 	message.Message = key
 
-	SendMsg(dht.Connection, remote.Address, message)
-	// register awaiting response with token
-	dht.AwaitingResponse[token] = time.Now()
-	dht.ExtraInfo[token] = key
-	dht.ResultChan[token] = make(chan interface{})
-
-	log.Println("Sending FIND_VALUE. Token is: ", token)
-
-	return token
-
+	return dht.Go(ctx, remote.Address, message)
 }
 
 func (dht *Kademlia) findValueResponse(remote *RemoteNode, token string, source NodeID, data interface{}) {
-	key, ok := data.(string)
+	k, ok := Payload(data)
 	if !ok {
-		panic(fmt.Sprintf("SHIT. params is %T | %#v\n", data, data))
+		log.Printf("DISCARDED FIND_VALUE from %s. params is %T", remote.Address, data)
+		return
 	}
+	key := string(k)
 
-	msgType := "FIND_VALUE_RESPONSE"
-
-	value, ok := dht.Node.Store[key]
-	if !ok {
-		value = dht.Node.GetClosestNodes(8)
-		// msgType = "FIND_VALUE_RESPONSE_ITERATIVE"
+	var response valueResponse
+	if records := dht.Node.getRecords(key); len(records) > 0 {
+		response = valueResponse{Found: true, Records: records}
+	} else {
+		response = valueResponse{Nodes: dht.Node.GetNClosestNodes(KeyID(key), K)}
 	}
 
 	message, _ := NewMessage()
-	message.MessageType = msgType
+	message.MessageType = "FIND_VALUE_RESPONSE"
 	message.SourceID = dht.Node.ID
-	message.InsertMessage(value)
+	message.InsertMessage(response)
 	message.Token = token
 
-	SendMsg(dht.Connection, remote.Address, message)
-
+	SendMsg(dht.Transport, remote.Address, message)
 }
 
+// the actual value (or nodes) are handled by the lookup that made the call
 func (dht *Kademlia) findValueResponseHandler(remote *RemoteNode, token string, source NodeID, data interface{}) {
-	defer delete(dht.AwaitingResponse, token)
-	defer delete(dht.ExtraInfo, token)
-	defer func() { remote.lastResponded = time.Now() }()
-
-	log.Println("IN FIND_VALUE_RESPONSE. Token is ", token)
-
-	// get target info
-	t, ok := dht.ExtraInfo[token]
-	if !ok {
-		// do something
-		panic("Nothing found in ExtraInfo. Weird")
-	}
-	target, ok := t.(string) // we can do this because all the keys are strings
-	if !ok {
-		panic("target key is supposed to be a string")
-	}
-
-	// unmarshal
-	p, _ := data.(string)
-	byteArrayP := []byte(p)
-	var remoteNodes []*RemoteNode
-	err := msgpack.Unmarshal(byteArrayP, &remoteNodes)
-
-	if err != nil {
-		// it's not a list of remotenodes - it's a nodeID
-		var nid NodeID
-		nidUnmarshallErr := msgpack.Unmarshal(byteArrayP, &nid)
-
-		if nidUnmarshallErr != nil {
-			log.Fatalf("data is not a nodeID. It is %#v(%T) Error: %s", data, data, nidUnmarshallErr)
-			return
-		}
-
-		r := dht.Node.GetNode(nid)
-
-		if r == nil {
-			panic("remote not found")
-		}
+	remote.touch()
+}
 
-		r.hasKey[target] = true
+// getPeers sends a single GET_PEERS query. Use GetPeers for the full iterative lookup
+func (dht *Kademlia) getPeers(ctx context.Context, remote *RemoteNode, key string) *Call {
+	message, _ := NewMessage()
+	message.MessageType = "GET_PEERS"
+	message.SourceID = dht.Node.ID
+	message.Message = key
 
-		// this means it's not a list of remote nodes.
-		ch, ok := dht.ResultChan[token]
-		if !ok {
-			panic("No Return Result Channel")
-		}
+	return dht.Go(ctx, remote.Address, message)
+}
 
-		ch <- byteArrayP
+func (dht *Kademlia) getPeersResponse(remote *RemoteNode, token string, source NodeID, data interface{}) {
+	k, ok := Payload(data)
+	if !ok {
+		log.Printf("DISCARDED GET_PEERS from %s. params is %T", remote.Address, data)
 		return
 	}
+	key := string(k)
 
-	log.Println("Not found. Looking Iteratively")
+	response := peersResponse{
+		Token: dht.secrets.token(remote.Address.IP),
+		Peers: dht.Node.Peers(key),
+		Nodes: dht.Node.GetNClosestNodes(KeyID(key), K),
+	}
 
-	// if a list of remoteNodes is returned, that means this remote node doesn't have the key
-	rN := dht.Node.GetNode(source)
-	rN.hasKey[target] = false
+	message, _ := NewMessage()
+	message.MessageType = "GET_PEERS_RESPONSE"
+	message.SourceID = dht.Node.ID
+	message.InsertMessage(response)
+	message.Token = token
 
-	var unseen []*RemoteNode = make([]*RemoteNode, 0)
-	for _, r := range remoteNodes {
+	SendMsg(dht.Transport, remote.Address, message)
+}
 
-		hasKey, ok := r.hasKey[target]
-		if !ok {
-			unseen = append(unseen, r)
-			continue
-		}
-		if !hasKey {
-			// has key but value = false
-			continue
-		}
+// the actual peers (and nodes) are handled by the lookup that made the call
+func (dht *Kademlia) getPeersResponseHandler(remote *RemoteNode, token string, source NodeID, data interface{}) {
+	remote.touch()
+}
 
-		// else, query again to see if this remote really has it
-		unseen = append(unseen, r)
+// announcePeer sends a single ANNOUNCE_PEER. The token has to come from a GET_PEERS to the same remote. Use AnnouncePeer instead
+func (dht *Kademlia) announcePeer(ctx context.Context, remote *RemoteNode, a announcement) *Call {
+	message, _ := NewMessage()
+	message.MessageType = "ANNOUNCE_PEER"
+	message.SourceID = dht.Node.ID
+	message.InsertMessage(a)
 
-	}
+	return dht.Go(ctx, remote.Address, message)
+}
 
-	for _, r := range unseen {
-		dht.FindValue(r, target)
+// announcePeerResponse only accepts announcements with a write token that was handed out to the same IP.
+// The peer's IP is always the one the announcement came from - nodes can only announce themselves
+func (dht *Kademlia) announcePeerResponse(remote *RemoteNode, token string, source NodeID, data interface{}) {
+	p, _ := Payload(data)
+
+	reply := "OK"
+	var a announcement
+	switch err := msgpack.Unmarshal(p, &a); {
+	case err != nil:
+		log.Printf("Unable to unmarshal ANNOUNCE_PEER. Error was: %s", err)
+		reply = "BAD_ANNOUNCEMENT"
+	case a.Key == "" || a.Port < 0 || a.Port > 65535:
+		reply = "BAD_ANNOUNCEMENT"
+	case !dht.secrets.valid(a.Token, remote.Address.IP):
+		log.Printf("DISCARDED ANNOUNCE_PEER of %q from %s: bad token", a.Key, remote.Address)
+		reply = "BAD_TOKEN"
+	default:
+		peer := &net.UDPAddr{IP: remote.Address.IP, Port: remote.Address.Port}
+		if a.Port != 0 {
+			peer.Port = a.Port
+		}
+		dht.Node.announcePeer(a.Key, peer)
 	}
 
-}
-
-func (dht *Kademlia) getPeers(remote *RemoteNode, params ...interface{}) {
+	message, _ := NewMessage()
+	message.MessageType = "ANNOUNCE_PEER_RESPONSE"
+	message.SourceID = dht.Node.ID
+	message.Message = reply
+	message.Token = token
 
+	SendMsg(dht.Transport, remote.Address, message)
 }
 
-func (dht *Kademlia) getPeersResponse(remote *RemoteNode, token string, source NodeID, data interface{}) {
-
+func (dht *Kademlia) announcePeerResponseHandler(remote *RemoteNode, token string, source NodeID, data interface{}) {
+	remote.touch()
 }
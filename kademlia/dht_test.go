@@ -0,0 +1,180 @@
+package kademlia
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestNetwork starts n nodes on a memory network, each bootstrapped off the first
+func newTestNetwork(t *testing.T, n int, seed int64) (*MemoryNetwork, []*Kademlia) {
+	mn := NewMemoryNetwork(seed)
+	mn.SetLatency(time.Millisecond, time.Millisecond)
+
+	var nodes []*Kademlia
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, newTestNode(t, mn, i, nodes))
+	}
+	return mn, nodes
+}
+
+// newTestNode starts a node on the memory network, and bootstraps it off the first of the others, if there are any
+func newTestNode(t *testing.T, mn *MemoryNetwork, i int, others []*Kademlia) *Kademlia {
+	transport, err := mn.Listen(&net.UDPAddr{IP: net.IPv4(10, 0, byte(i/250), byte(i%250+1)), Port: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := NewKademlia()
+	k.Transport = transport
+	k.Timeout = 200 * time.Millisecond
+	go k.Run()
+	t.Cleanup(func() { k.Close() })
+
+	if len(others) > 0 {
+		if responded, _ := k.Bootstrap(context.Background(), []string{others[0].Transport.LocalAddr().String()}); responded == 0 {
+			t.Fatalf("%s couldn't bootstrap", transport.LocalAddr())
+		}
+	}
+	return k
+}
+
+// lots of lookups, stores and announces at once, from every node. Run with -race
+func TestConcurrentLookups(t *testing.T) {
+	_, nodes := newTestNetwork(t, 30, 1)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(nodes)*4)
+	for i, k := range nodes {
+		i, k := i, k
+		key := fmt.Sprintf("room %d", i%5)
+
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			if closest := k.FindNode(ctx, newNodeID()); len(closest) == 0 {
+				errs <- fmt.Errorf("node %d found no nodes", i)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if n := k.Publish(ctx, key, k.Node.ID); n == 0 {
+				errs <- fmt.Errorf("node %d published %q to no one", i, key)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if n := k.AnnouncePeer(ctx, key, 2000+i); n == 0 {
+				errs <- fmt.Errorf("node %d announced %q to no one", i, key)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			// the routing table is read and written while all that goes on
+			for j := 0; j < 20; j++ {
+				k.Node.GetNClosestNodes(newNodeID(), K)
+				k.Node.Contacts()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// everything that was published can be found from anywhere, by many lookups at once
+	for i, k := range nodes {
+		i, k := i, k
+		key := fmt.Sprintf("room %d", (i+1)%5)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if providers, ok := k.FindValue(ctx, key); !ok || len(providers) == 0 {
+				t.Errorf("node %d couldn't find %q", i, key)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if peers := k.GetPeers(ctx, key); len(peers) == 0 {
+				t.Errorf("node %d found no peers for %q", i, key)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// a node that says it has the value, but has nothing valid, doesn't end the lookup
+func TestFindValuePastEmptyAnswers(t *testing.T) {
+	mn, nodes := newTestNetwork(t, 12, 2)
+	ctx := context.Background()
+
+	publisher := nodes[5]
+	if n := publisher.Publish(ctx, "room", publisher.Node.ID); n == 0 {
+		t.Fatal("published to no one")
+	}
+	// the seeker comes along afterwards, so it doesn't have the value itself
+	seeker := newTestNode(t, mn, len(nodes), nodes)
+
+	// the nodes closest to the key are the first to be asked. Make them liars
+	liars := append([]*Kademlia(nil), nodes...)
+	sort.Slice(liars, func(i, j int) bool {
+		return liars[i].Node.ID.DistanceTo(KeyID("room")).LessThan(liars[j].Node.ID.DistanceTo(KeyID("room")))
+	})
+	liars = liars[:ALPHA]
+	for _, k := range liars {
+		if k == publisher {
+			continue
+		}
+		k := k
+		k.Handle("FIND_VALUE", func(remote *RemoteNode, token string, source NodeID, data interface{}) {
+			message, _ := NewMessage()
+			message.MessageType = "FIND_VALUE_RESPONSE"
+			message.SourceID = k.Node.ID
+			message.InsertMessage(valueResponse{Found: true, Records: []record{{Key: "something else"}}})
+			message.Token = token
+			SendMsg(k.Transport, remote.Address, message)
+		})
+	}
+
+	providers, ok := seeker.FindValue(ctx, "room")
+	if !ok || len(providers) != 1 {
+		t.Fatalf("expected the one provider. Got %v", providers)
+	}
+}
+
+// packets that don't carry what they should are dropped, and the node carries on
+func TestMalformedPacketsAreDropped(t *testing.T) {
+	mn, nodes := newTestNetwork(t, 2, 3)
+	k := nodes[0]
+	sender, err := mn.Listen(&net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	malformed := []Message{
+		{MessageType: "FIND_NODE", SourceID: newNodeID(), Message: 42},
+		{MessageType: "FIND_NODE", SourceID: newNodeID(), Message: []byte("short")},
+		{MessageType: "FIND_VALUE", SourceID: newNodeID(), Message: 42},
+		{MessageType: "GET_PEERS", SourceID: newNodeID(), Message: 42},
+		{MessageType: "PING", SourceID: NodeID("short")},
+		{MessageType: "PING"},
+	}
+	for i, msg := range malformed {
+		msg.Token = fmt.Sprintf("malformed %d", i)
+		SendMsg(sender, k.Transport.LocalAddr(), msg)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if call := <-nodes[1].PingIP(context.Background(), k.Transport.LocalAddr()).Done; call.Error != nil {
+		t.Fatalf("the node didn't answer after the malformed packets: %s", call.Error)
+	}
+	if remote, ok := k.Node.GetNodeFromAddress(sender.LocalAddr().String()); ok && len(remote.ID) != ID_SIZE {
+		t.Error("a node with a short ID made it into the routing table")
+	}
+}
@@ -0,0 +1,216 @@
+package kademlia
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// framing: every message is sent as one or more fragments, each in its own datagram, and put back together on the other side.
+// A fragment is a header followed by up to FRAGMENT_SIZE bytes of the message. The header is:
+//
+//	magic (1 byte) | message ID (8 bytes) | fragment index (2 bytes) | fragment count (2 bytes)
+//
+// all big endian.
+const (
+	FRAGMENT_MAGIC     = 0x4e             // 'N'. Anything that doesn't start with this isn't a fragment, and is dropped
+	FRAGMENT_HEADER    = 1 + 8 + 2 + 2    // magic, message ID, index, count
+	FRAGMENT_SIZE      = 1024             // bytes of message per fragment. This keeps datagrams well under the usual MTU
+	MAX_MESSAGE_SIZE   = 1 << 20          // the default maximum size of a message. Bigger ones aren't sent, or put back together
+	REASSEMBLY_TIMEOUT = 10 * time.Second // the default for how long a message has to be complete in, before it's given up on
+	MAX_REASSEMBLIES   = 1024             // how many messages can be being put back together at once. Beyond this, new ones are dropped
+	MAX_COMPLETED      = 16 * 1024        // how many completed messages are remembered for spotting duplicates. Beyond this, the oldest are forgotten early
+)
+
+// ErrMessageTooLarge is returned when sending a message bigger than the maximum message size
+var ErrMessageTooLarge = errors.New("message too large")
+
+type reassembly struct {
+	fragments [][]byte
+	received  int
+	size      int
+	started   time.Time
+}
+
+// FramedTransport fragments messages over another transport, so messages aren't limited to what fits in a datagram.
+// Reassembly times out, duplicate fragments (and duplicates of messages that have already been put back together) are dropped
+type FramedTransport struct {
+	Transport
+	MaxMessageSize    int           // messages bigger than this are neither sent nor received
+	ReassemblyTimeout time.Duration // messages that aren't complete within this long are given up on
+
+	nextID uint64
+
+	partial        map[string]*reassembly // key is sender address + message ID
+	completed      map[string]time.Time   // same key. These are remembered for a while so duplicates can be spotted
+	completedOrder []string               // the keys of completed, oldest first
+	lastSweep      time.Time
+
+	lock sync.Mutex
+}
+
+func NewFramedTransport(t Transport) *FramedTransport {
+	// message IDs start at a random number, so a restarted node doesn't get its new messages taken for duplicates
+	var b [8]byte
+	rand.Read(b[:])
+
+	return &FramedTransport{
+		Transport:         t,
+		MaxMessageSize:    MAX_MESSAGE_SIZE,
+		ReassemblyTimeout: REASSEMBLY_TIMEOUT,
+
+		nextID:    binary.BigEndian.Uint64(b[:]),
+		partial:   make(map[string]*reassembly),
+		completed: make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+func (t *FramedTransport) Send(b []byte, addr *net.UDPAddr) error {
+	if len(b) > t.MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+
+	count := (len(b) + FRAGMENT_SIZE - 1) / FRAGMENT_SIZE
+	if count == 0 {
+		count = 1 // empty messages still get sent
+	}
+	if count > 0xffff {
+		return ErrMessageTooLarge
+	}
+
+	id := atomic.AddUint64(&t.nextID, 1)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * FRAGMENT_SIZE
+		if end > len(b) {
+			end = len(b)
+		}
+		chunk := b[i*FRAGMENT_SIZE : end]
+
+		fragment := make([]byte, FRAGMENT_HEADER+len(chunk))
+		fragment[0] = FRAGMENT_MAGIC
+		binary.BigEndian.PutUint64(fragment[1:], id)
+		binary.BigEndian.PutUint16(fragment[9:], uint16(i))
+		binary.BigEndian.PutUint16(fragment[11:], uint16(count))
+		copy(fragment[FRAGMENT_HEADER:], chunk)
+
+		if err := t.Transport.Send(fragment, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Receive blocks until a whole message has arrived
+func (t *FramedTransport) Receive() ([]byte, *net.UDPAddr, error) {
+	for {
+		fragment, from, err := t.Transport.Receive()
+		if err != nil {
+			return nil, nil, err
+		}
+		if b, ok := t.reassemble(fragment, from); ok {
+			return b, from, nil
+		}
+	}
+}
+
+// reassemble adds the fragment to its message. When the message is complete, it's returned
+func (t *FramedTransport) reassemble(fragment []byte, from *net.UDPAddr) ([]byte, bool) {
+	if len(fragment) < FRAGMENT_HEADER || fragment[0] != FRAGMENT_MAGIC {
+		return nil, false
+	}
+	id := binary.BigEndian.Uint64(fragment[1:])
+	index := int(binary.BigEndian.Uint16(fragment[9:]))
+	count := int(binary.BigEndian.Uint16(fragment[11:]))
+	chunk := fragment[FRAGMENT_HEADER:]
+	if count == 0 || index >= count || (count-1)*FRAGMENT_SIZE >= t.MaxMessageSize {
+		return nil, false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.sweep()
+
+	key := fmt.Sprintf("%s/%d", from, id)
+	if _, ok := t.completed[key]; ok {
+		return nil, false // duplicate
+	}
+
+	if count == 1 {
+		t.complete(key)
+		return append([]byte(nil), chunk...), true
+	}
+
+	r, ok := t.partial[key]
+	if !ok {
+		if len(t.partial) >= MAX_REASSEMBLIES {
+			return nil, false
+		}
+		r = &reassembly{fragments: make([][]byte, count), started: time.Now()}
+		t.partial[key] = r
+	}
+	if len(r.fragments) != count || r.fragments[index] != nil {
+		return nil, false // duplicate, or something's lying about the count
+	}
+
+	r.fragments[index] = append([]byte(nil), chunk...)
+	r.received++
+	r.size += len(chunk)
+	if r.size > t.MaxMessageSize {
+		delete(t.partial, key)
+		t.complete(key) // so the rest of it doesn't start another reassembly
+		return nil, false
+	}
+	if r.received < count {
+		return nil, false
+	}
+
+	delete(t.partial, key)
+	t.complete(key)
+
+	b := make([]byte, 0, r.size)
+	for _, f := range r.fragments {
+		b = append(b, f...)
+	}
+	return b, true
+}
+
+// complete remembers that the message is done with. Only the last MAX_COMPLETED are, so a fast sender can't make this
+// grow without end. It's called with the lock held
+func (t *FramedTransport) complete(key string) {
+	t.completed[key] = time.Now()
+	t.completedOrder = append(t.completedOrder, key)
+	for len(t.completedOrder) > MAX_COMPLETED {
+		t.forgetOldest()
+	}
+}
+
+func (t *FramedTransport) forgetOldest() {
+	delete(t.completed, t.completedOrder[0])
+	t.completedOrder = t.completedOrder[1:]
+}
+
+// sweep gives up on the messages that have taken too long, and forgets the completed ones after a while.
+// It's called with the lock held
+func (t *FramedTransport) sweep() {
+	if time.Since(t.lastSweep) < t.ReassemblyTimeout {
+		return
+	}
+	t.lastSweep = time.Now()
+
+	for key, r := range t.partial {
+		if time.Since(r.started) > t.ReassemblyTimeout {
+			delete(t.partial, key)
+		}
+	}
+	// a duplicate can't arrive much later than the original, so completed messages are only kept for a couple of timeouts
+	for len(t.completedOrder) > 0 && time.Since(t.completed[t.completedOrder[0]]) > 2*t.ReassemblyTimeout {
+		t.forgetOldest()
+	}
+}
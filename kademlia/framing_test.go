@@ -0,0 +1,232 @@
+package kademlia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// newFramedPair returns two framed transports on a memory network. Fragments can be sent by hand on the sender's Transport
+func newFramedPair(t *testing.T) (receiver *FramedTransport, sender *FramedTransport) {
+	mn := NewMemoryNetwork(1)
+	r, err := mn.Listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := mn.Listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close(); s.Close() })
+	return NewFramedTransport(r), NewFramedTransport(s)
+}
+
+// fragment makes a fragment by hand, the same way Send does
+func fragment(id uint64, index, count int, chunk []byte) []byte {
+	f := make([]byte, FRAGMENT_HEADER+len(chunk))
+	f[0] = FRAGMENT_MAGIC
+	binary.BigEndian.PutUint64(f[1:], id)
+	binary.BigEndian.PutUint16(f[9:], uint16(index))
+	binary.BigEndian.PutUint16(f[11:], uint16(count))
+	copy(f[FRAGMENT_HEADER:], chunk)
+	return f
+}
+
+// sendFragments sends the fragments of b with the indices in order. Nil means all of them, in order
+func sendFragments(t *testing.T, sender *FramedTransport, to *net.UDPAddr, id uint64, b []byte, order []int) {
+	count := (len(b) + FRAGMENT_SIZE - 1) / FRAGMENT_SIZE
+	if count == 0 {
+		count = 1
+	}
+	if order == nil {
+		for i := 0; i < count; i++ {
+			order = append(order, i)
+		}
+	}
+	for _, i := range order {
+		end := (i + 1) * FRAGMENT_SIZE
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := sender.Transport.Send(fragment(id, i, count, b[i*FRAGMENT_SIZE:end]), to); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// receive receives everything that comes out of the receiver, from the start - so the memory network's queue never fills
+func receive(t *testing.T, receiver *FramedTransport) <-chan []byte {
+	out := make(chan []byte, MAX_REASSEMBLIES)
+	go func() {
+		defer close(out)
+		for {
+			b, _, err := receiver.Receive()
+			if err != nil {
+				return
+			}
+			out <- b
+		}
+	}()
+	return out
+}
+
+// receiveUntil returns everything up to the end marker, which is sent after whatever's being tested. The memory
+// network delivers in order, so whatever came out of the test is before it
+func receiveUntil(t *testing.T, received <-chan []byte, receiver *FramedTransport, sender *FramedTransport) [][]byte {
+	if err := sender.Send([]byte("end"), receiver.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]byte
+	for {
+		select {
+		case b := <-received:
+			if string(b) == "end" {
+				return got
+			}
+			got = append(got, b)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the end marker never came")
+		}
+	}
+}
+
+func TestFraming(t *testing.T) {
+	cases := []struct {
+		name  string
+		size  int
+		order []int // of the fragments sent. Nil means all of them, in order
+		want  int   // messages that come out
+	}{
+		{"empty", 0, nil, 1},
+		{"one fragment", 100, nil, 1},
+		{"exactly one fragment", FRAGMENT_SIZE, nil, 1},
+		{"several fragments", 5*FRAGMENT_SIZE + 7, nil, 1},
+		{"out of order", 3 * FRAGMENT_SIZE, []int{2, 0, 1}, 1},
+		{"duplicate fragments", 3*FRAGMENT_SIZE - 1, []int{0, 0, 1, 2, 1, 2}, 1},
+		{"the whole message twice", 2 * FRAGMENT_SIZE, []int{0, 1, 0, 1}, 1},
+		{"a fragment missing", 3 * FRAGMENT_SIZE, []int{0, 2}, 0},
+	}
+
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			receiver, sender := newFramedPair(t)
+			received := receive(t, receiver)
+			b := make([]byte, tc.size)
+			rand.New(rand.NewSource(int64(i))).Read(b)
+
+			sendFragments(t, sender, receiver.LocalAddr(), uint64(i), b, tc.order)
+			got := receiveUntil(t, received, receiver, sender)
+			if len(got) != tc.want {
+				t.Fatalf("expected %d message(s). Got %d", tc.want, len(got))
+			}
+			for _, m := range got {
+				if !bytes.Equal(m, b) {
+					t.Errorf("the message didn't come out the same. Got %d bytes, expected %d", len(m), len(b))
+				}
+			}
+		})
+	}
+}
+
+func TestFramingMaxMessageSize(t *testing.T) {
+	receiver, sender := newFramedPair(t)
+	received := receive(t, receiver)
+	receiver.MaxMessageSize = 2 * FRAGMENT_SIZE
+
+	// too big to send
+	sender.MaxMessageSize = 2 * FRAGMENT_SIZE
+	if err := sender.Send(make([]byte, 2*FRAGMENT_SIZE+1), receiver.LocalAddr()); err != ErrMessageTooLarge {
+		t.Errorf("expected ErrMessageTooLarge. Got %v", err)
+	}
+
+	// and too big to be put back together, from a sender that doesn't care
+	sendFragments(t, sender, receiver.LocalAddr(), 1, make([]byte, 3*FRAGMENT_SIZE), nil)
+	// fragments that don't say how big the message is up front
+	big := make([]byte, 3*FRAGMENT_SIZE)
+	for i := 0; i < 3; i++ {
+		sender.Transport.Send(fragment(2, i, 3, big[:FRAGMENT_SIZE]), receiver.LocalAddr())
+	}
+	// one that's just right
+	sendFragments(t, sender, receiver.LocalAddr(), 3, make([]byte, 2*FRAGMENT_SIZE), nil)
+
+	got := receiveUntil(t, received, receiver, sender)
+	if len(got) != 1 || len(got[0]) != 2*FRAGMENT_SIZE {
+		t.Fatalf("expected only the message that fits. Got %d message(s)", len(got))
+	}
+}
+
+// partials is how many messages are being put back together
+func partials(t *FramedTransport) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.partial)
+}
+
+func TestFramingMaxReassemblies(t *testing.T) {
+	receiver, sender := newFramedPair(t)
+	received := receive(t, receiver)
+
+	// the first half of as many messages as can be put back together at once, and then one more whole one. They're sent
+	// a few at a time, as that's as many as the memory network's queue holds
+	half := make([]byte, FRAGMENT_SIZE)
+	for id := 0; id < MAX_REASSEMBLIES; id++ {
+		sender.Transport.Send(fragment(uint64(id), 0, 2, half), receiver.LocalAddr())
+		if (id+1)%(MEMORY_QUEUE_SIZE/4) == 0 {
+			for deadline := time.Now().Add(5 * time.Second); partials(receiver) < id+1; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("only %d of %d first halves got there", partials(receiver), id+1)
+				}
+			}
+		}
+	}
+	sendFragments(t, sender, receiver.LocalAddr(), MAX_REASSEMBLIES, make([]byte, 2*FRAGMENT_SIZE), nil)
+	if got := receiveUntil(t, received, receiver, sender); len(got) != 0 {
+		t.Fatalf("a message got put back together past MAX_REASSEMBLIES")
+	}
+
+	// the ones that are already going can still finish
+	sender.Transport.Send(fragment(0, 1, 2, half), receiver.LocalAddr())
+	if got := receiveUntil(t, received, receiver, sender); len(got) != 1 {
+		t.Fatalf("expected the message that was already being put back together. Got %d message(s)", len(got))
+	}
+}
+
+func TestFramingReassemblyTimeout(t *testing.T) {
+	receiver, sender := newFramedPair(t)
+	received := receive(t, receiver)
+	receiver.ReassemblyTimeout = 50 * time.Millisecond
+
+	half := make([]byte, FRAGMENT_SIZE)
+	sender.Transport.Send(fragment(1, 0, 2, half), receiver.LocalAddr())
+	time.Sleep(2 * receiver.ReassemblyTimeout)
+	sender.Transport.Send(fragment(1, 1, 2, half), receiver.LocalAddr())
+
+	if got := receiveUntil(t, received, receiver, sender); len(got) != 0 {
+		t.Fatal("a message was put back together after it was given up on")
+	}
+}
+
+// however fast messages come in, only so many are remembered
+func TestFramingCompletedIsCapped(t *testing.T) {
+	receiver, _ := newFramedPair(t)
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+
+	for id := 0; id < MAX_COMPLETED+100; id++ {
+		if _, ok := receiver.reassemble(fragment(uint64(id), 0, 1, []byte(fmt.Sprint(id))), from); !ok {
+			t.Fatalf("message %d didn't come out", id)
+		}
+	}
+	if len(receiver.completed) > MAX_COMPLETED || len(receiver.completedOrder) > MAX_COMPLETED {
+		t.Errorf("%d completed messages are remembered. Expected at most %d", len(receiver.completed), MAX_COMPLETED)
+	}
+
+	// the most recent are still spotted as duplicates
+	if _, ok := receiver.reassemble(fragment(MAX_COMPLETED+99, 0, 1, nil), from); ok {
+		t.Error("a duplicate of a recent message came out")
+	}
+}
@@ -0,0 +1,268 @@
+package kademlia
+
+import (
+	"context"
+	"sort"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// a shortlist is the list of candidates during an iterative lookup, kept sorted by XOR distance to the target
+type shortlist struct {
+	target NodeID
+	nodes  []*RemoteNode
+
+	seen      map[string]bool // key is the node ID
+	queried   map[string]bool
+	responded map[string]bool
+	hops      map[string]int // how many hops away each node was found. The nodes in our own routing table are 1 hop away
+}
+
+func newShortlist(target NodeID) *shortlist {
+	return &shortlist{
+		target: target,
+		nodes:  make([]*RemoteNode, 0),
+
+		seen:      make(map[string]bool),
+		queried:   make(map[string]bool),
+		responded: make(map[string]bool),
+		hops:      make(map[string]int),
+	}
+}
+
+func (s *shortlist) Len() int      { return len(s.nodes) }
+func (s *shortlist) Swap(i, j int) { s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i] }
+func (s *shortlist) Less(i, j int) bool {
+	return s.nodes[i].ID.DistanceTo(s.target).LessThan(s.nodes[j].ID.DistanceTo(s.target))
+}
+
+// add puts the nodes in the shortlist if they haven't been seen before. Nodes with broken IDs or addresses are skipped
+func (s *shortlist) add(nodes []*RemoteNode, hops int) {
+	for _, r := range nodes {
+		if r == nil || r.Address == nil || len(r.ID) != ID_SIZE {
+			continue
+		}
+		if s.seen[string(r.ID)] {
+			continue
+		}
+		s.seen[string(r.ID)] = true
+		s.hops[string(r.ID)] = hops
+		s.nodes = append(s.nodes, r)
+	}
+	sort.Sort(s)
+}
+
+// remove takes out a node that failed to respond. It is still marked as seen so it won't be added back in
+func (s *shortlist) remove(remote *RemoteNode) {
+	for i, r := range s.nodes {
+		if string(r.ID) == string(remote.ID) {
+			s.nodes = append(s.nodes[:i], s.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+// next returns the closest node amongst the k closest that hasn't been queried yet, or nil if there are none
+func (s *shortlist) next() *RemoteNode {
+	for i, r := range s.nodes {
+		if i >= K {
+			break
+		}
+		if !s.queried[string(r.ID)] {
+			return r
+		}
+	}
+	return nil
+}
+
+// closest returns up to n of the closest nodes that responded
+func (s *shortlist) closest(n int) []*RemoteNode {
+	retVal := make([]*RemoteNode, 0, n)
+	for _, r := range s.nodes {
+		if len(retVal) == n {
+			break
+		}
+		if s.responded[string(r.ID)] {
+			retVal = append(retVal, r)
+		}
+	}
+	return retVal
+}
+
+// LookupStats is how a lookup went
+type LookupStats struct {
+	Hops      int // how many hops away the closest node found was
+	Queried   int
+	Responded int
+}
+
+func (s *shortlist) stats() LookupStats {
+	stats := LookupStats{Queried: len(s.queried), Responded: len(s.responded)}
+	if closest := s.closest(1); len(closest) > 0 {
+		stats.Hops = s.hops[string(closest[0].ID)]
+	}
+	return stats
+}
+
+type lookupReply struct {
+	remote  *RemoteNode
+	nodes   []*RemoteNode
+	records []record // only filled in by FIND_VALUE
+	peers   [][]byte // only filled in by GET_PEERS. Compact form
+	token   []byte   // only filled in by GET_PEERS. This is what lets us announce to the remote
+	found   bool
+	ok      bool
+}
+
+// a queryFunc sends a single query to a remote and returns the call
+type queryFunc func(ctx context.Context, remote *RemoteNode) *Call
+
+// FindNode performs an iterative node lookup for the target. It keeps Alpha queries in flight,
+// and stops when the K closest nodes it knows of have all responded. The K closest nodes are returned
+func (dht *Kademlia) FindNode(ctx context.Context, target NodeID) []*RemoteNode {
+	closest, _ := dht.FindNodeStats(ctx, target)
+	return closest
+}
+
+// FindNodeStats is FindNode, but also tells how the lookup went
+func (dht *Kademlia) FindNodeStats(ctx context.Context, target NodeID) ([]*RemoteNode, LookupStats) {
+	sl, _ := dht.iterate(ctx, target, func(ctx context.Context, remote *RemoteNode) *Call {
+		return dht.findNode(ctx, remote, target)
+	}, nil)
+	return sl.closest(K), sl.stats()
+}
+
+// FindValue performs an iterative value lookup. The providers found at the first node that has any valid ones are returned,
+// and the rest of the queries are abandoned. They are then cached at the closest node that was seen without them
+func (dht *Kademlia) FindValue(ctx context.Context, key string) ([]Provider, bool) {
+	if providers, ok := dht.Node.Get(key); ok {
+		return providers, true
+	}
+
+	// a node that says it has the value, but doesn't have anything usable, doesn't end the lookup
+	sl, found := dht.iterate(ctx, KeyID(key), func(ctx context.Context, remote *RemoteNode) *Call {
+		return dht.findValue(ctx, remote, key)
+	}, func(reply *lookupReply) bool {
+		if !reply.found {
+			return false
+		}
+		var valid []record
+		for _, rec := range reply.records {
+			if rec.Key != key || len(rec.Publisher) != ID_SIZE || rec.expired() {
+				continue
+			}
+			valid = append(valid, rec)
+		}
+		reply.records = valid
+		return len(valid) > 0
+	})
+	if found == nil {
+		return nil, false
+	}
+	records := found.records
+
+	// caching step: store at the closest node that didn't have it
+	for _, r := range sl.closest(K) {
+		if string(r.ID) == string(found.remote.ID) {
+			continue
+		}
+		for _, rec := range records {
+			dht.storeRecord(ctx, r, rec)
+		}
+		break
+	}
+
+	providers := make([]Provider, 0, len(records))
+	for _, rec := range records {
+		providers = append(providers, rec.provider())
+	}
+	return providers, len(providers) > 0
+}
+
+// iterate is the actual iterative lookup. It returns the shortlist once the lookup converges.
+// Every good reply is passed to done (if there is one) first. If done returns true, the lookup bails out there and then,
+// returning that reply as well
+func (dht *Kademlia) iterate(ctx context.Context, target NodeID, query queryFunc, done func(*lookupReply) bool) (*shortlist, *lookupReply) {
+	dht.Node.lookedUp(target)
+
+	sl := newShortlist(target)
+	sl.seen[string(dht.Node.ID)] = true // never query self
+	sl.add(dht.Node.GetNClosestNodes(target, K), 1)
+
+	alpha := dht.Alpha
+	if alpha < 1 {
+		alpha = ALPHA
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // abandons any queries still in flight
+
+	replies := make(chan lookupReply)
+	inFlight := 0
+	for {
+		for inFlight < alpha {
+			r := sl.next()
+			if r == nil {
+				break
+			}
+			sl.queried[string(r.ID)] = true
+			inFlight++
+			go dht.await(ctx, r, query(ctx, r), replies)
+		}
+
+		if inFlight == 0 {
+			break // converged: every one of the k closest has been asked and has responded (or been dropped)
+		}
+
+		var reply lookupReply
+		select {
+		case reply = <-replies:
+		case <-ctx.Done():
+			return sl, nil
+		}
+
+		inFlight--
+		if !reply.ok {
+			sl.remove(reply.remote)
+			continue
+		}
+		if done != nil && done(&reply) {
+			return sl, &reply
+		}
+		sl.responded[string(reply.remote.ID)] = true
+		sl.add(reply.nodes, sl.hops[string(reply.remote.ID)]+1)
+	}
+
+	return sl, nil
+}
+
+// await waits on a call, and passes whatever comes out of it to the lookup
+func (dht *Kademlia) await(ctx context.Context, remote *RemoteNode, call *Call, replies chan<- lookupReply) {
+	<-call.Done
+
+	reply := lookupReply{remote: remote}
+	if call.Error == nil {
+		p, _ := Payload(call.Reply)
+		switch call.ReplyType {
+		case "FIND_NODE_RESPONSE":
+			reply.ok = msgpack.Unmarshal(p, &reply.nodes) == nil
+		case "FIND_VALUE_RESPONSE":
+			var response valueResponse
+			reply.ok = msgpack.Unmarshal(p, &response) == nil
+			reply.nodes = response.Nodes
+			reply.records = response.Records
+			reply.found = response.Found
+		case "GET_PEERS_RESPONSE":
+			var response peersResponse
+			reply.ok = msgpack.Unmarshal(p, &response) == nil
+			reply.nodes = response.Nodes
+			reply.peers = response.Peers
+			reply.token = response.Token
+		}
+	}
+
+	select {
+	case replies <- reply:
+	case <-ctx.Done():
+	}
+}
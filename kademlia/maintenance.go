@@ -0,0 +1,64 @@
+package kademlia
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	MAINTENANCE_INTERVAL = 10 * time.Minute // how often the routing table is looked after
+	REFRESH_INTERVAL     = time.Hour        // buckets without a lookup in their range for this long get refreshed
+	STALE_INTERVAL       = 15 * time.Minute // contacts not heard from for this long get pinged
+	MAX_FAILURES         = 3                // contacts that fail this many pings in a row are removed
+)
+
+// Maintain is the periodic upkeep of the routing table: it refreshes the buckets that haven't been looked up recently,
+// checks that the contacts that have gone quiet are still alive, and then spring cleans the address index.
+// After that, the store is looked after: expired records and peers go, and the rest of the records are republished as needed.
+// Lastly the state is saved, so a crash loses at most one maintenance interval's worth of contacts
+func (dht *Kademlia) Maintain() {
+	dht.refreshBuckets()
+	dht.checkLiveness()
+	dht.Node.SpringClean()
+
+	dht.Node.ExpireRecords()
+	dht.Node.ExpirePeers()
+	dht.republish()
+
+	dht.saveState()
+}
+
+// refreshBuckets looks up a random ID in the range of every bucket that hasn't had a lookup in the past hour
+func (dht *Kademlia) refreshBuckets() {
+	for _, bucketID := range dht.Node.StaleBuckets(REFRESH_INTERVAL) {
+		dht.FindNode(context.Background(), dht.Node.RandomIDInBucket(bucketID))
+	}
+}
+
+// checkLiveness pings the contacts that haven't been heard from in a while. The ones that keep failing are removed,
+// which lets the replacement caches fill the gaps
+func (dht *Kademlia) checkLiveness() {
+	var wg sync.WaitGroup
+	for _, remote := range dht.Node.Contacts() {
+		if since(remote.LastResponded()) < STALE_INTERVAL {
+			continue
+		}
+
+		wg.Add(1)
+		go func(remote *RemoteNode) {
+			defer wg.Done()
+
+			call := <-dht.Ping(context.Background(), remote).Done
+			if call.Error == nil {
+				return // the PONG already touched it
+			}
+			if remote.failed() >= MAX_FAILURES {
+				log.Printf("Removing %s after %d failed pings", remote.Address, MAX_FAILURES)
+				dht.Node.Delete(remote)
+			}
+		}(remote)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,240 @@
+package kademlia
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const MEMORY_QUEUE_SIZE = 1024 // packets that arrive when a memory transport's queue is full are dropped, as a full socket buffer would
+
+// ErrClosed is returned by a closed memory transport
+var ErrClosed = errors.New("transport closed")
+
+type memoryPacket struct {
+	b    []byte
+	from *net.UDPAddr
+}
+
+// MemoryNetwork connects MemoryTransports in the same process. It can be made as bad as a real network:
+// packets can be delayed, lost, not get across a partition, or be filtered by a NAT. All of these can be changed at any time.
+//
+// Given the same seed and the same sequence of sends, the same packets are lost
+type MemoryNetwork struct {
+	latency time.Duration
+	jitter  time.Duration // extra random delay on top of the latency, up to this much
+	loss    float64       // the probability that a packet is lost
+
+	transports map[string]*MemoryTransport // key is the address
+	partition  map[string]int              // key is the address. Only addresses in the same group can talk. Nil means no partition
+	nat        map[string]map[string]bool  // key is the address of a node behind a NAT. The values are the addresses it has sent to
+
+	sent, delivered, dropped int
+
+	rand *rand.Rand
+	lock sync.Mutex
+}
+
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+	return &MemoryNetwork{
+		transports: make(map[string]*MemoryTransport),
+		nat:        make(map[string]map[string]bool),
+		rand:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetLatency sets how long packets take to arrive. Each packet takes an extra random delay of up to jitter on top of that,
+// which means packets can arrive out of order
+func (n *MemoryNetwork) SetLatency(latency, jitter time.Duration) {
+	n.lock.Lock()
+	n.latency, n.jitter = latency, jitter
+	n.lock.Unlock()
+}
+
+// SetLoss sets the probability of a packet getting lost, from 0 to 1
+func (n *MemoryNetwork) SetLoss(p float64) {
+	n.lock.Lock()
+	n.loss = p
+	n.lock.Unlock()
+}
+
+// Partition splits the network up into the groups. Packets only get across between addresses in the same group.
+// Addresses that aren't in any group can't talk to anyone
+func (n *MemoryNetwork) Partition(groups ...[]*net.UDPAddr) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.partition = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.partition[addr.String()] = i
+		}
+	}
+}
+
+// Heal removes the partition
+func (n *MemoryNetwork) Heal() {
+	n.lock.Lock()
+	n.partition = nil
+	n.lock.Unlock()
+}
+
+// SetNAT puts the address behind a NAT, or takes it out from behind one. A node behind a NAT can send to anyone,
+// but only gets packets from the addresses it has sent to - so nobody can reach it first
+func (n *MemoryNetwork) SetNAT(addr *net.UDPAddr, behind bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if !behind {
+		delete(n.nat, addr.String())
+		return
+	}
+	if _, ok := n.nat[addr.String()]; !ok {
+		n.nat[addr.String()] = make(map[string]bool)
+	}
+}
+
+// Stats returns how many packets have been sent, how many of them arrived, and how many were dropped along the way
+func (n *MemoryNetwork) Stats() (sent, delivered, dropped int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.sent, n.delivered, n.dropped
+}
+
+// Listen creates a transport at the address. It fails if the address is already taken
+func (n *MemoryNetwork) Listen(addr *net.UDPAddr) (*MemoryTransport, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.transports[addr.String()]; ok {
+		return nil, errors.New("address already in use: " + addr.String())
+	}
+	t := &MemoryTransport{
+		network: n,
+		addr:    addr,
+		queue:   make(chan memoryPacket, MEMORY_QUEUE_SIZE),
+		closed:  make(chan struct{}),
+	}
+	n.transports[addr.String()] = t
+	return t, nil
+}
+
+// route decides the fate of a packet: whether it gets there at all, and when
+func (n *MemoryNetwork) route(from, to *net.UDPAddr) (dst *MemoryTransport, delay time.Duration, ok bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.sent++
+	if holes, ok := n.nat[from.String()]; ok {
+		holes[to.String()] = true // the reply can come back through this
+	}
+
+	dst, ok = n.transports[to.String()]
+	if !ok {
+		n.dropped++
+		return nil, 0, false
+	}
+	if holes, ok := n.nat[to.String()]; ok && !holes[from.String()] {
+		n.dropped++
+		return nil, 0, false
+	}
+	if n.partition != nil {
+		a, okA := n.partition[from.String()]
+		b, okB := n.partition[to.String()]
+		if !okA || !okB || a != b {
+			n.dropped++
+			return nil, 0, false
+		}
+	}
+	if n.loss > 0 && n.rand.Float64() < n.loss {
+		n.dropped++
+		return nil, 0, false
+	}
+
+	delay = n.latency
+	if n.jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(n.jitter)))
+	}
+	return dst, delay, true
+}
+
+func (n *MemoryNetwork) count(delivered bool) {
+	n.lock.Lock()
+	if delivered {
+		n.delivered++
+	} else {
+		n.dropped++
+	}
+	n.lock.Unlock()
+}
+
+func (n *MemoryNetwork) remove(addr *net.UDPAddr) {
+	n.lock.Lock()
+	delete(n.transports, addr.String())
+	n.lock.Unlock()
+}
+
+// MemoryTransport is a Transport on a MemoryNetwork
+type MemoryTransport struct {
+	network *MemoryNetwork
+	addr    *net.UDPAddr
+
+	queue     chan memoryPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *MemoryTransport) Send(b []byte, addr *net.UDPAddr) error {
+	select {
+	case <-t.closed:
+		return ErrClosed
+	default:
+	}
+
+	dst, delay, ok := t.network.route(t.addr, addr)
+	if !ok {
+		return nil // lost, as far as anyone can tell
+	}
+
+	// the packet is copied, as the sender is free to reuse b
+	p := memoryPacket{b: append([]byte(nil), b...), from: t.addr}
+	if delay <= 0 {
+		dst.deliver(p)
+		return nil
+	}
+	time.AfterFunc(delay, func() { dst.deliver(p) })
+	return nil
+}
+
+func (t *MemoryTransport) deliver(p memoryPacket) {
+	select {
+	case <-t.closed:
+		t.network.count(false)
+	case t.queue <- p:
+		t.network.count(true)
+	default:
+		t.network.count(false) // queue's full
+	}
+}
+
+func (t *MemoryTransport) Receive() ([]byte, *net.UDPAddr, error) {
+	select {
+	case p := <-t.queue:
+		return p.b, p.from, nil
+	case <-t.closed:
+		return nil, nil, ErrClosed
+	}
+}
+
+func (t *MemoryTransport) LocalAddr() *net.UDPAddr { return t.addr }
+
+// Close takes the transport off the network. Packets to its address are lost from then on
+func (t *MemoryTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		t.network.remove(t.addr)
+	})
+	return nil
+}
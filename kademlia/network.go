@@ -1,10 +1,8 @@
 package kademlia
 
 import (
-	"fmt"
 	"log"
 	"net"
-	"time"
 
 	"github.com/google/uuid"
 	"github.com/vmihailenco/msgpack"
@@ -36,63 +34,60 @@ func (msg *Message) InsertMessage(message interface{}) {
 	msg.Message = marshalled
 }
 
-func SendMsg(conn *net.UDPConn, returnAddress *net.UDPAddr, msg Message) {
+// Payload gets the raw bytes out of a decoded Message.Message.
+// Depending on the msgpack version, raw bytes come out as either a string or a []byte
+func Payload(data interface{}) ([]byte, bool) {
+	switch d := data.(type) {
+	case []byte:
+		return d, true
+	case string:
+		return []byte(d), true
+	}
+	return nil, false
+}
+
+func SendMsg(t Transport, returnAddress *net.UDPAddr, msg Message) {
 	b, err := msgpack.Marshal(msg)
 	if err != nil {
 		// do something!
 	}
-	bytesWritten, networkErr := conn.WriteToUDP(b, returnAddress)
 
-	if networkErr != nil {
-		log.Fatalf("FAILED TO WRITE %d BYTES. Reason: %v", bytesWritten, networkErr)
+	if networkErr := t.Send(b, returnAddress); networkErr != nil {
+		log.Printf("FAILED TO WRITE %d BYTES. Reason: %v", len(b), networkErr)
 	}
 }
 
 func (dht *Kademlia) initNetwork() {
-	address := fmt.Sprintf(":%d", dht.Node.Port)
-
-	listener, err := net.ListenPacket("udp4", address)
-
+	transport, err := NewUDPTransport(dht.Node.Port)
 	if err != nil {
 		// do something
 		panic(err) // temp. TODO: replace with actual error handling.
 	}
 
-	var socket *net.UDPConn
-	if listener != nil {
-		socket = listener.(*net.UDPConn)
-	}
-
-	dht.Connection = socket
+	dht.Transport = NewFramedTransport(transport)
 }
 
 func (dht *Kademlia) readFromSocket() {
 	for {
-		var b []byte = make([]byte, 1024)
-		n, addr, err := dht.Connection.ReadFromUDP(b)
-
-		b = b[0:n]
-
+		b, addr, err := dht.Transport.Receive()
 		if err != nil {
-			panic("HELP!!") // do actual proper error handling kthxbai
+			select {
+			case <-dht.kill:
+			default:
+				log.Printf("Unable to read from the transport, giving up. Error was: %s", err)
+			}
+			return
 		}
 
-		if n > 0 {
+		if len(b) > 0 {
 			pack := packet{b, addr}
 			select {
 			case dht.packets <- pack:
 				continue
 			case <-dht.kill:
-				break
+				return
 			}
 		}
-
-		select {
-		case <-dht.kill:
-			break
-		default:
-			continue
-		}
 	}
 }
 
@@ -106,10 +101,20 @@ func (dht *Kademlia) processPackets() {
 			log.Printf("Failed to unmarshal message in packet.")
 			continue
 		}
+		if len(msg.SourceID) != ID_SIZE {
+			log.Printf("DISCARDED %s from %s. The source ID is %d bytes", msg.MessageType, pack.returnAddress, len(msg.SourceID))
+			continue
+		}
 
 		//check and see if node exists
-		remote := dht.Node.GetOrCreateNode(msg.SourceID, pack.returnAddress.String())
+		remote, stale := dht.Node.GetOrCreateNode(msg.SourceID, pack.returnAddress.String())
+		remote.touch() // any message at all means it's alive
+		if stale != nil {
+			go dht.evict(stale)
+		}
+		dht.lock.Lock()
 		dht.pendingEnvelopes[msg.Token] = remote
+		dht.lock.Unlock()
 
 		dht.requests <- msg
 	}
@@ -118,27 +123,35 @@ func (dht *Kademlia) processPackets() {
 // yay for replicating Go's basic RPC functions
 func (dht *Kademlia) handleMessages() {
 	for msg := range dht.requests {
+		dht.lock.Lock()
 		_, ok := dht.pendingQueries[msg.Token]
 		if ok { // todo: check the time since
+			dht.lock.Unlock()
 			continue // request is being worked on.
 		}
+		dht.pendingQueries[msg.Token] = now()
+		remote := dht.pendingEnvelopes[msg.Token]
+		f, ok := dht.responseHandler[msg.MessageType]
 
-		dht.pendingQueries[msg.Token] = time.Now()
+		// once that is done, delete pending stuff
+		delete(dht.pendingQueries, msg.Token)
+		delete(dht.pendingEnvelopes, msg.Token)
+		dht.lock.Unlock()
+
+		// complete any outstanding call this message is a response to. This happens before looking for
+		// a handler, because not every response has one
+		dht.resolveCall(msg, remote)
 
-		f, ok := dht.ResponseHandler[msg.MessageType]
 		if !ok {
 			// BAD SHIT HAPPENS HERE
 			log.Printf("DISCARDED (No Response Handler): %#v \n", msg.MessageType)
-			delete(dht.pendingQueries, msg.Token)
 			continue
 		}
 
-		remote, ok := dht.pendingEnvelopes[msg.Token]
-		if !ok {
+		if remote == nil {
 			// BAD SHIT HAPPENS HERE
+			continue
 		}
 		go f(remote, msg.Token, msg.SourceID, msg.Message)
-		delete(dht.pendingQueries, msg.Token) // once that is done, delete pending stuff
-		delete(dht.pendingEnvelopes, msg.Token)
 	}
 }
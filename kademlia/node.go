@@ -3,8 +3,11 @@ package kademlia
 import (
 	"container/list"
 	"crypto/rand"
+	"crypto/sha1"
 	"log"
 	"net"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -12,6 +15,9 @@ const (
 	ID_SIZE     int = 20
 	BUCKET_SIZE int = 20
 	K               = 8
+	ALPHA           = 3 // number of concurrent queries in flight during a lookup
+
+	REPLACEMENT_CACHE_SIZE = BUCKET_SIZE // per bucket
 )
 
 type NodeID []byte
@@ -32,6 +38,12 @@ func newEmptyNodeID() NodeID {
 	return NodeID(make([]byte, ID_SIZE))
 }
 
+// KeyID maps a key onto the ID space, so that values can be looked up the same way nodes are
+func KeyID(key string) NodeID {
+	h := sha1.Sum([]byte(key))
+	return NodeID(h[:])
+}
+
 func (id NodeID) String() string {
 	// return string(id[:])
 	return string(id)
@@ -39,7 +51,6 @@ func (id NodeID) String() string {
 
 func (id NodeID) DistanceTo(cmp NodeID) NodeID {
 	res := newEmptyNodeID()
-	log.Printf("CMP Length: %d %d %d\n", len(cmp), len(res), len(id))
 	for i := 0; i < ID_SIZE; i++ {
 		res[i] = id[i] ^ cmp[i]
 	}
@@ -55,13 +66,14 @@ func (id NodeID) EqualsTo(cmp NodeID) bool {
 	return true
 }
 
+// LessThan compares two IDs as big endian numbers. Comparing distances with this is how the lookups sort their shortlists
 func (id NodeID) LessThan(cmp NodeID) bool {
 	for i := 0; i < ID_SIZE; i++ {
-		if id[i] > cmp[i] {
-			return false
+		if id[i] != cmp[i] {
+			return id[i] < cmp[i]
 		}
 	}
-	return true
+	return false
 }
 
 func (id NodeID) GetBucketID() int {
@@ -93,9 +105,10 @@ type RemoteNode struct {
 	ID            NodeID
 	Address       *net.UDPAddr
 	lastResponded time.Time
+	failures      int // consecutive failed pings
 	verifiedBy    []*RemoteNode
 
-	hasKey map[string]bool
+	lock sync.Mutex // guards lastResponded and failures
 }
 
 func newRemoteNode(ID NodeID, addr *net.UDPAddr) *RemoteNode {
@@ -103,33 +116,143 @@ func newRemoteNode(ID NodeID, addr *net.UDPAddr) *RemoteNode {
 		ID:         ID,
 		Address:    addr,
 		verifiedBy: make([]*RemoteNode, 0),
-
-		hasKey: make(map[string]bool),
 	}
 }
 
-type Node struct {
-	ID            NodeID
-	IP            string
-	Port          int
-	RoutingTable  *routingTable
-	AddressToNode map[string]*RemoteNode
+// touch records that the remote node has just responded
+func (r *RemoteNode) touch() {
+	r.lock.Lock()
+	r.lastResponded = now()
+	r.failures = 0
+	r.lock.Unlock()
+}
+
+// failed records a failed ping, and returns the number of consecutive failures so far
+func (r *RemoteNode) failed() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures++
+	return r.failures
+}
+
+// failing says whether the last ping to the remote node failed
+func (r *RemoteNode) failing() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.failures > 0
+}
+
+func (r *RemoteNode) LastResponded() time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastResponded
+}
 
-	Store map[string]interface{}
+// Node is safe for concurrent use. The routing table, the address index and the store are all guarded by lock,
+// so they are only to be accessed through the methods
+type Node struct {
+	ID   NodeID
+	IP   string
+	Port int
+
+	table         *routingTable
+	replacements  *routingTable          // nodes that didn't fit into a full bucket. Same layout as the table
+	lastLookup    [ID_SIZE * 8]time.Time // when each bucket last had a lookup in its range
+	addressToNode map[string]*RemoteNode
+	store         map[string]map[string]record    // key -> provider ID -> record
+	peers         map[string]map[string]time.Time // key -> compact peer -> when it was announced
+
+	lock sync.RWMutex
 }
 
 func NewNode() *Node {
-	return &Node{
+	node := &Node{
 		ID:            newNodeID(),
-		RoutingTable:  newRoutingTable(),
-		AddressToNode: make(map[string]*RemoteNode),
+		table:         newRoutingTable(),
+		replacements:  newRoutingTable(),
+		addressToNode: make(map[string]*RemoteNode),
+
+		store: make(map[string]map[string]record),
+		peers: make(map[string]map[string]time.Time),
+	}
+
+	t := now()
+	for i := range node.lastLookup {
+		node.lastLookup[i] = t
+	}
+	return node
+}
+
+// lookedUp records that a lookup has happened in the range of the target's bucket
+func (node *Node) lookedUp(target NodeID) {
+	node.lock.Lock()
+	node.lastLookup[node.ID.DistanceTo(target).GetBucketID()] = now()
+	node.lock.Unlock()
+}
+
+// StaleBuckets returns the non-empty buckets that haven't had a lookup in their range for longer than age
+func (node *Node) StaleBuckets(age time.Duration) []int {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+
+	var retVal []int
+	for i, bucket := range node.table {
+		if bucket.Len() > 0 && since(node.lastLookup[i]) > age {
+			retVal = append(retVal, i)
+		}
+	}
+	return retVal
+}
 
-		Store: make(map[string]interface{}),
+// RandomIDInBucket generates a random ID that would fall into the bucket. Looking it up refreshes the bucket
+func (node *Node) RandomIDInBucket(bucketID int) NodeID {
+	distance := newNodeID()
+
+	// the bucket ID is the position of the highest set bit of the distance, counting from the least significant bit
+	bit := ID_SIZE*8 - 1 - bucketID
+	for i := 0; i < bit/8; i++ {
+		distance[i] = 0
+	}
+	shift := uint(7 - bit%8)
+	distance[bit/8] &= byte(1)<<shift - 1
+	distance[bit/8] |= byte(1) << shift
+
+	return node.ID.DistanceTo(distance)
+}
+
+// Contacts returns all the nodes in the routing table
+func (node *Node) Contacts() []*RemoteNode {
+	var retVal []*RemoteNode
+	for _, bucket := range node.Buckets() {
+		retVal = append(retVal, bucket...)
 	}
+	return retVal
+}
+
+// Buckets returns a snapshot of the routing table
+func (node *Node) Buckets() [][]*RemoteNode {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+
+	retVal := make([][]*RemoteNode, len(node.table))
+	for i, bucket := range node.table {
+		for elem := bucket.Front(); elem != nil; elem = elem.Next() {
+			if e, ok := elem.Value.(*RemoteNode); ok {
+				retVal[i] = append(retVal[i], e)
+			}
+		}
+	}
+	return retVal
 }
 
 // R
-func (node Node) GetNodeFromAddress(address string) (remote *RemoteNode, exists bool) {
+func (node *Node) GetNodeFromAddress(address string) (remote *RemoteNode, exists bool) {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+	return node.getNodeFromAddress(address)
+}
+
+func (node *Node) getNodeFromAddress(address string) (remote *RemoteNode, exists bool) {
 	if address == "" {
 		panic("No Address")
 	}
@@ -143,62 +266,98 @@ func (node Node) GetNodeFromAddress(address string) (remote *RemoteNode, exists
 		panic("Something went wrong, and resolution failed")
 	}
 
-	remote, exists = node.AddressToNode[addr.String()]
+	remote, exists = node.addressToNode[addr.String()]
 	return
 }
 
 // C & U
-func (node Node) Update(cmp *RemoteNode) {
+// Update moves a node to the front of its bucket, or adds it if there is space.
+// If the bucket is full, the node goes into the bucket's replacement cache instead, and the least recently seen node
+// of the bucket is returned. The caller should ping it, and Delete it if it doesn't respond - that promotes the replacement
+func (node *Node) Update(cmp *RemoteNode) (stale *RemoteNode) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	return node.update(cmp)
+}
+
+func (node *Node) update(cmp *RemoteNode) (stale *RemoteNode) {
+	if cmp.ID.EqualsTo(node.ID) {
+		return nil // we don't put ourselves in our own routing table
+	}
+
 	bucketID := node.ID.DistanceTo(cmp.ID).GetBucketID()
-	bucket := node.RoutingTable[bucketID]
+	bucket := node.table[bucketID]
 
-	var found bool = false
-	var foundElement *list.Element
+	if elem := findInList(bucket, cmp.ID); elem != nil {
+		elem.Value = cmp // update the  foundElement value
+		bucket.MoveToFront(elem)
+		return nil
+	}
 
-	for elem := bucket.Front(); elem != nil; elem = elem.Next() {
+	if bucket.Len() < BUCKET_SIZE {
+		bucket.PushFront(cmp)
+		return nil
+	}
+
+	// bucket's full. The newcomer waits in the replacement cache, most recently seen at the front
+	replacements := node.replacements[bucketID]
+	if elem := findInList(replacements, cmp.ID); elem != nil {
+		elem.Value = cmp
+		replacements.MoveToFront(elem)
+	} else {
+		replacements.PushFront(cmp)
+		if replacements.Len() > REPLACEMENT_CACHE_SIZE {
+			replacements.Remove(replacements.Back())
+		}
+	}
+
+	stale, _ = bucket.Back().Value.(*RemoteNode)
+	return stale
+}
+
+// findInList returns the element holding the node with the ID, or nil
+func findInList(l *list.List, id NodeID) *list.Element {
+	for elem := l.Front(); elem != nil; elem = elem.Next() {
 		e, ok := elem.Value.(*RemoteNode)
 		if !ok {
-			continue // if it's not a NodeID, wtf is it doing in the list?? Probably should error out
-		}
-		if e.ID.EqualsTo(cmp.ID) || e.ID.EqualsTo(node.ID) {
-			found = true
-			foundElement = elem
-			break
+			continue // if it's not a RemoteNode, wtf is it doing in the list?? Probably should error out
 		}
-	}
-	if !found {
-		if bucket.Len() <= BUCKET_SIZE {
-			bucket.PushFront(cmp)
+		if e.ID.EqualsTo(id) {
+			return elem
 		}
-	} else {
-		foundElement.Value = cmp // update the  foundElement value
-		bucket.MoveToFront(foundElement)
 	}
+	return nil
 }
 
-func (node Node) GetOrCreateNode(id NodeID, address string) (remote *RemoteNode) {
-	remote, exists := node.GetNodeFromAddress(address)
+// GetOrCreateNode returns the remote node at the address, creating it if needed, and then updates the routing table with it.
+// stale is as per Update()
+func (node *Node) GetOrCreateNode(id NodeID, address string) (remote *RemoteNode, stale *RemoteNode) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
 
-	if exists {
-		return remote
-	}
+	remote, exists := node.getNodeFromAddress(address)
 
-	addr, err := net.ResolveUDPAddr("udp", address)
+	if !exists {
+		addr, err := net.ResolveUDPAddr("udp", address)
 
-	if err != nil {
-		panic("Shit")
-	}
+		if err != nil {
+			panic("Shit")
+		}
 
-	remote = newRemoteNode(id, addr)
-	node.AddressToNode[addr.String()] = remote
-	node.Update(remote)
+		remote = newRemoteNode(id, addr)
+		node.addressToNode[addr.String()] = remote
+	}
 
+	stale = node.update(remote)
 	return
 }
 
-func (node Node) GetNode(id NodeID) (remote *RemoteNode) {
+func (node *Node) GetNode(id NodeID) (remote *RemoteNode) {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+
 	bucketID := node.ID.DistanceTo(id).GetBucketID()
-	bucket := node.RoutingTable[bucketID]
+	bucket := node.table[bucketID]
 	for elem := bucket.Front(); elem != nil; elem = elem.Next() {
 		e, ok := elem.Value.(*RemoteNode)
 		if !ok {
@@ -212,90 +371,71 @@ func (node Node) GetNode(id NodeID) (remote *RemoteNode) {
 }
 
 // D
-func (node Node) Delete(remote *RemoteNode) {
-	delete(node.AddressToNode, remote.Address.String())
-	bucketID := remote.ID.DistanceTo(node.ID).GetBucketID()
-	bucket := node.RoutingTable[bucketID]
-	for elem := bucket.Front(); elem != nil; elem = elem.Next() {
-		e, ok := elem.Value.(*RemoteNode)
-		if !ok {
-			continue
-		}
-		if e == remote {
-			bucket.Remove(elem)
-		}
-	}
-}
-
-func (node Node) GetNClosestNodes(target NodeID, n int) []*RemoteNode {
-	bucketID := target.DistanceTo(node.ID).GetBucketID()
-	bucket := node.RoutingTable[bucketID]
+// Delete removes the node from the routing table. The most recently seen node in the bucket's replacement cache takes its place
+func (node *Node) Delete(remote *RemoteNode) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
 
-	var retVal []*RemoteNode
+	delete(node.addressToNode, remote.Address.String())
+	bucketID := remote.ID.DistanceTo(node.ID).GetBucketID()
+	bucket := node.table[bucketID]
+	replacements := node.replacements[bucketID]
 
-	for elem := bucket.Front(); elem != nil; elem = elem.Next() {
-		e, ok := elem.Value.(*RemoteNode)
-		if !ok {
-			continue // TODO: proper erroring out
-		}
+	if elem := findInList(replacements, remote.ID); elem != nil {
+		replacements.Remove(elem)
+	}
 
-		retVal = append(retVal, e)
+	elem := findInList(bucket, remote.ID)
+	if elem == nil {
+		return
 	}
+	bucket.Remove(elem)
 
-	if len(retVal) < n {
-		// then we need more. so we iterate through the rest of the buckets
-		goto lookaheadandback
-	} else {
-		if len(retVal) > n {
-			retVal = retVal[:n] // trim to the required size
-		}
-		return retVal
+	if front := replacements.Front(); front != nil {
+		replacements.Remove(front)
+		bucket.PushFront(front.Value)
 	}
+}
 
-	// this goto block is just for organizational purposes
-lookaheadandback:
-	for i := 1; (len(retVal) < n) && (bucketID-i >= 0 || bucketID+i < ID_SIZE*8); i++ {
-		if bucketID+i < ID_SIZE*8 {
-			// look ahead i buckets
+// GetNClosestNodes returns the n nodes in the routing table closest to the target, by XOR distance.
+// Nodes in the buckets nearer to us than the target's bucket are closer to the target than the ones further away,
+// so the simplest correct thing to do is to just sort the lot. Distances are worked out once, before sorting
+func (node *Node) GetNClosestNodes(target NodeID, n int) []*RemoteNode {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
 
-			lookAheadBucket := node.RoutingTable[bucketID+i]
-			for elem := lookAheadBucket.Front(); elem != nil; elem = elem.Next() {
-				e, ok := elem.Value.(*RemoteNode)
-				if !ok {
-					continue // proper errors plz kthxbai
-				}
-				retVal = append(retVal, e)
+	type candidate struct {
+		remote   *RemoteNode
+		distance NodeID
+	}
+	var candidates []candidate
+	for _, bucket := range node.table {
+		for elem := bucket.Front(); elem != nil; elem = elem.Next() {
+			e, ok := elem.Value.(*RemoteNode)
+			if !ok || e.Address == nil || len(e.ID) != ID_SIZE {
+				continue // proper errors plz kthxbai
 			}
+			candidates = append(candidates, candidate{e, e.ID.DistanceTo(target)})
 		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].distance.LessThan(candidates[j].distance) })
 
-		// we prioritize lookaheads over lookbacks
-		if len(retVal) > n {
-			break
-		}
-
-		if bucketID-i >= 0 {
-			// look back i buckets
-
-			lookBackBucket := node.RoutingTable[bucketID-i]
-			for elem := lookBackBucket.Front(); elem != nil; elem = elem.Next() {
-				e, ok := elem.Value.(*RemoteNode)
-				if !ok {
-					continue // proper errors plz kthxbai
-				}
-
-				retVal = append(retVal, e)
-			}
-		}
+	if len(candidates) > n {
+		candidates = candidates[:n]
 	}
-	if len(retVal) > n {
-		retVal = retVal[:n]
+	retVal := make([]*RemoteNode, len(candidates))
+	for i, c := range candidates {
+		retVal[i] = c.remote
 	}
 	return retVal
 }
 
-func (node Node) GetClosestNodes(n int) []*RemoteNode {
+func (node *Node) GetClosestNodes(n int) []*RemoteNode {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+
 	var resVal []*RemoteNode
-	for _, bucket := range node.RoutingTable {
+	for _, bucket := range node.table {
 		for elem := bucket.Front(); elem != nil; elem = elem.Next() {
 			e, ok := elem.Value.(*RemoteNode)
 			if !ok {
@@ -312,13 +452,16 @@ func (node Node) GetClosestNodes(n int) []*RemoteNode {
 	return resVal
 }
 
-func (node Node) GetNearestNode() *RemoteNode {
-	for i, bucket := range node.RoutingTable {
-		log.Println("Bucket #", i, bucket)
+// GetNearestNode returns a contact from the nearest bucket that has one. Contacts that failed their last ping are passed
+// over - they're on their way out, see checkLiveness
+func (node *Node) GetNearestNode() *RemoteNode {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+
+	for _, bucket := range node.table {
 		for elem := bucket.Front(); elem != nil; elem = elem.Next() {
-			log.Println(elem.Value)
 			e, ok := elem.Value.(*RemoteNode)
-			if !ok {
+			if !ok || e.failing() {
 				continue
 			}
 			return e
@@ -327,17 +470,26 @@ func (node Node) GetNearestNode() *RemoteNode {
 	return nil
 }
 
-// spring clean basically purges the AddressToNode map, and refills it.
+// spring clean basically purges the AddressToNode map, and refills it with what's in the routing table and the replacement caches.
+// This drops the nodes that got pushed out of the replacement caches, or that were never put in the table at all.
 // spring cleaning should ideally happen every 10 minutes or so
-func (node Node) SpringClean() {
-	node.AddressToNode = make(map[string]*RemoteNode)
-	for _, bucket := range node.RoutingTable {
-		for elem := bucket.Front(); elem != nil; elem = elem.Next() {
-			e, ok := elem.Value.(*RemoteNode)
-			if !ok {
-				bucket.Remove(elem)
+func (node *Node) SpringClean() {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	node.addressToNode = make(map[string]*RemoteNode)
+	for _, rt := range []*routingTable{node.table, node.replacements} {
+		for _, bucket := range rt {
+			var next *list.Element
+			for elem := bucket.Front(); elem != nil; elem = next {
+				next = elem.Next()
+				e, ok := elem.Value.(*RemoteNode)
+				if !ok {
+					bucket.Remove(elem)
+					continue
+				}
+				node.addressToNode[e.Address.String()] = e
 			}
-			node.AddressToNode[e.Address.String()] = e
 		}
 	}
 }
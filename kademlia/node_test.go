@@ -0,0 +1,23 @@
+package kademlia
+
+import "testing"
+
+// a contact that's failing its pings isn't handed out while there's one that isn't
+func TestGetNearestNodeSkipsFailing(t *testing.T) {
+	node := NewNode()
+	dead, _ := node.GetOrCreateNode(newNodeID(), "10.0.0.1:1000")
+	dead.failed()
+	if node.GetNearestNode() != nil {
+		t.Fatal("the only contact is failing, but it was handed out")
+	}
+
+	alive, _ := node.GetOrCreateNode(newNodeID(), "10.0.0.2:1000")
+	if got := node.GetNearestNode(); got != alive {
+		t.Errorf("expected %s. Got %v", alive.Address, got)
+	}
+
+	dead.touch()
+	if node.GetNearestNode() == nil {
+		t.Error("a contact that answered again isn't handed out")
+	}
+}
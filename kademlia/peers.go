@@ -0,0 +1,259 @@
+package kademlia
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// this is more or less BEP-5 (the BitTorrent DHT): a node announces that it's a peer for a key, and anyone can look up the peers.
+// Unlike STORE, an announce has to present a write token that the remote handed out to the announcing IP in an earlier GET_PEERS,
+// so nodes can only ever announce themselves, and only where they've actually looked
+const (
+	PEER_TTL               = 30 * time.Minute // peers that haven't reannounced for this long are dropped
+	REANNOUNCE_INTERVAL    = 15 * time.Minute // how often our own announcements are redone
+	SECRET_ROTATE_INTERVAL = 5 * time.Minute  // how often the secret behind the write tokens changes. Tokens last up to twice as long
+)
+
+// peersResponse is what a GET_PEERS gets back. The closest nodes to the key are always sent so the lookup can carry on,
+// along with whatever peers the remote knows of
+type peersResponse struct {
+	Token []byte
+	Peers [][]byte // compact form
+	Nodes []*RemoteNode
+}
+
+// announcement is what ANNOUNCE_PEER carries. A zero port means the port the announce was sent from
+type announcement struct {
+	Key   string
+	Port  int
+	Token []byte
+}
+
+// compactPeer packs an address BEP-5 style: the IP (4 bytes for IPv4, 16 for IPv6) followed by the port as 2 bytes, big endian
+func compactPeer(addr *net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	b := make([]byte, len(ip)+2)
+	copy(b, ip)
+	binary.BigEndian.PutUint16(b[len(ip):], uint16(addr.Port))
+	return b
+}
+
+// parseCompactPeer is the reverse of compactPeer. Nil is returned if it's not a compact peer
+func parseCompactPeer(b []byte) *net.UDPAddr {
+	if len(b) != net.IPv4len+2 && len(b) != net.IPv6len+2 {
+		return nil
+	}
+	ip := make(net.IP, len(b)-2)
+	copy(ip, b)
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(b[len(b)-2:]))}
+}
+
+/* WRITE TOKENS */
+
+// secrets are what write tokens are made from. The previous secret is kept around so tokens don't die the moment it rotates
+type secrets struct {
+	current, previous []byte
+	sync.Mutex
+}
+
+func newSecret() []byte {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // shit
+	}
+	return b
+}
+
+func (s *secrets) rotate() {
+	s.Lock()
+	s.previous, s.current = s.current, newSecret()
+	s.Unlock()
+}
+
+func writeToken(secret []byte, ip net.IP) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4 // the same IP can come in 4 or 16 byte form
+	}
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(ip)
+	return h.Sum(nil)
+}
+
+// token is the write token for the IP
+func (s *secrets) token(ip net.IP) []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.current == nil {
+		s.current = newSecret()
+	}
+	return writeToken(s.current, ip)
+}
+
+// valid checks that the token was handed out to the IP recently
+func (s *secrets) valid(token []byte, ip net.IP) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, secret := range [][]byte{s.current, s.previous} {
+		if secret != nil && subtle.ConstantTimeCompare(token, writeToken(secret, ip)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+/* PEER STORE */
+
+// announcePeer adds (or refreshes) a peer for the key
+func (node *Node) announcePeer(key string, addr *net.UDPAddr) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	peers, ok := node.peers[key]
+	if !ok {
+		peers = make(map[string]time.Time)
+		node.peers[key] = peers
+	}
+	peers[string(compactPeer(addr))] = now()
+}
+
+// Peers returns the live peers that have announced the key to this node, in compact form
+func (node *Node) Peers(key string) [][]byte {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+
+	var retVal [][]byte
+	for peer, announced := range node.peers[key] {
+		if since(announced) > PEER_TTL {
+			continue
+		}
+		retVal = append(retVal, []byte(peer))
+	}
+	return retVal
+}
+
+// ExpirePeers drops the peers that haven't reannounced in time
+func (node *Node) ExpirePeers() {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	for k, peers := range node.peers {
+		for peer, announced := range peers {
+			if since(announced) > PEER_TTL {
+				delete(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			delete(node.peers, k)
+		}
+	}
+}
+
+/* PUBLIC API */
+
+// peerLookup is the result of an iterative GET_PEERS
+type peerLookup struct {
+	peers  map[string]*net.UDPAddr // key is the compact form
+	tokens map[string][]byte       // key is the node ID
+	sl     *shortlist
+}
+
+func (dht *Kademlia) lookupPeers(ctx context.Context, key string) *peerLookup {
+	pl := &peerLookup{
+		peers:  make(map[string]*net.UDPAddr),
+		tokens: make(map[string][]byte),
+	}
+	addPeers := func(peers [][]byte) {
+		for _, b := range peers {
+			if addr := parseCompactPeer(b); addr != nil {
+				pl.peers[string(b)] = addr
+			}
+		}
+	}
+
+	addPeers(dht.Node.Peers(key))
+	pl.sl, _ = dht.iterate(ctx, KeyID(key), func(ctx context.Context, remote *RemoteNode) *Call {
+		return dht.getPeers(ctx, remote, key)
+	}, func(reply *lookupReply) bool {
+		addPeers(reply.peers)
+		if len(reply.token) > 0 {
+			pl.tokens[string(reply.remote.ID)] = reply.token
+		}
+		return false // keep going: unlike a value, the peers are spread out over all the closest nodes
+	})
+	return pl
+}
+
+// GetPeers finds the peers for the key, by asking all of the K closest nodes to the key
+func (dht *Kademlia) GetPeers(ctx context.Context, key string) []*net.UDPAddr {
+	pl := dht.lookupPeers(ctx, key)
+
+	retVal := make([]*net.UDPAddr, 0, len(pl.peers))
+	for _, addr := range pl.peers {
+		retVal = append(retVal, addr)
+	}
+	return retVal
+}
+
+// AnnouncePeer announces this node as a peer for the key on the K closest nodes to the key. A zero port means
+// whichever port the announce comes from, i.e. the DHT port. The announcement is redone every REANNOUNCE_INTERVAL
+// for as long as this node lives. The number of nodes that accepted the announcement is returned
+func (dht *Kademlia) AnnouncePeer(ctx context.Context, key string, port int) int {
+	dht.lock.Lock()
+	dht.announced[key] = port
+	dht.lock.Unlock()
+
+	return dht.announce(ctx, key, port)
+}
+
+func (dht *Kademlia) announce(ctx context.Context, key string, port int) int {
+	pl := dht.lookupPeers(ctx, key)
+
+	var calls []*Call
+	for _, remote := range pl.sl.closest(K) {
+		token, ok := pl.tokens[string(remote.ID)]
+		if !ok {
+			continue
+		}
+		calls = append(calls, dht.announcePeer(ctx, remote, announcement{Key: key, Port: port, Token: token}))
+	}
+
+	accepted := 0
+	for _, call := range calls {
+		c := <-call.Done
+		if c.Error != nil {
+			continue
+		}
+		if p, _ := Payload(c.Reply); string(p) == "OK" {
+			accepted++
+		}
+	}
+	return accepted
+}
+
+// Reannounce redoes our own announcements. Run does this every REANNOUNCE_INTERVAL
+func (dht *Kademlia) Reannounce() {
+	dht.lock.Lock()
+	announced := make(map[string]int, len(dht.announced))
+	for key, port := range dht.announced {
+		announced[key] = port
+	}
+	dht.lock.Unlock()
+
+	for key, port := range announced {
+		n := dht.announce(context.Background(), key, port)
+		log.Printf("Reannounced %s to %d nodes", key, n)
+	}
+}
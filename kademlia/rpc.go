@@ -0,0 +1,177 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	RPC_TIMEOUT    = time.Second      // how long to wait for a response before resending a request
+	RPC_RETRIES    = 2                // how many times a request is resent before giving up
+	TOKEN_TTL      = 2 * time.Minute  // tokens that have been waiting for longer than this are swept
+	SWEEP_INTERVAL = 30 * time.Second // how often the sweeper runs
+)
+
+// ErrTokenInUse is what a call gets if there's already one waiting on a response with the same token
+var ErrTokenInUse = errors.New("there's already a call waiting on a response with that token")
+
+// TimeoutError is returned when a request has not been responded to in time
+type TimeoutError struct {
+	MessageType string
+	Token       string
+	Attempts    int
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s (token %s) timed out after %d attempt(s)", e.MessageType, e.Token, e.Attempts)
+}
+
+// Call is an outstanding request. This is more or less the same as net/rpc's Call:
+// when the call completes (a response arrives, or it times out), Done receives the call itself.
+//
+// A response is a message that comes back with the same token, and one of the message types that answer the request (see Expect)
+type Call struct {
+	Message Message      // the request
+	Address *net.UDPAddr // where the request was sent
+
+	ReplyType string      // the message type of the response
+	Reply     interface{} // the data of the response, as received
+	Remote    *RemoteNode // who responded
+
+	Error error
+	Done  chan *Call
+
+	replied chan struct{}
+}
+
+// Go sends the message, and resends it until a response comes, the retries run out, or ctx is done.
+// The message's token is used to match up the response, so there can only be one call waiting on each token - any
+// more are done straight away, with ErrTokenInUse
+func (dht *Kademlia) Go(ctx context.Context, addr *net.UDPAddr, message Message) *Call {
+	call := &Call{
+		Message: message,
+		Address: addr,
+		Done:    make(chan *Call, 1),
+
+		replied: make(chan struct{}),
+	}
+
+	dht.lock.Lock()
+	if _, ok := dht.calls[message.Token]; ok {
+		dht.lock.Unlock()
+		call.Error = ErrTokenInUse
+		call.Done <- call
+		return call
+	}
+	dht.calls[message.Token] = call
+	dht.awaitingResponse[message.Token] = now()
+	dht.lock.Unlock()
+
+	go dht.send(ctx, call)
+	return call
+}
+
+// Call sends the message and waits for the response. The error is a *TimeoutError if no response came in time
+func (dht *Kademlia) Call(ctx context.Context, addr *net.UDPAddr, message Message) (*Call, error) {
+	call := <-dht.Go(ctx, addr, message).Done
+	return call, call.Error
+}
+
+func (dht *Kademlia) send(ctx context.Context, call *Call) {
+	timeout := dht.Timeout
+	if timeout <= 0 {
+		timeout = RPC_TIMEOUT
+	}
+
+	for attempts := 1; ; attempts++ {
+		SendMsg(dht.Transport, call.Address, call.Message)
+
+		timer := time.NewTimer(timeout)
+		select {
+		case <-call.replied:
+			timer.Stop()
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			var err error = &TimeoutError{call.Message.MessageType, call.Message.Token, attempts}
+			if ctx.Err() == context.Canceled {
+				err = ctx.Err()
+			}
+			dht.finishCall(call, err)
+			return
+		case <-timer.C:
+			if attempts > dht.Retries {
+				dht.finishCall(call, &TimeoutError{call.Message.MessageType, call.Message.Token, attempts})
+				return
+			}
+		}
+	}
+}
+
+// resolveCall is called for every message that comes in. If the message is a response to an outstanding call, the call is completed
+func (dht *Kademlia) resolveCall(msg Message, remote *RemoteNode) {
+	dht.lock.Lock()
+	call, ok := dht.calls[msg.Token]
+	if !ok || !dht.answers(call.Message.MessageType, msg.MessageType) {
+		dht.lock.Unlock()
+		return
+	}
+	delete(dht.calls, msg.Token)
+	delete(dht.awaitingResponse, msg.Token)
+	dht.lock.Unlock()
+
+	call.ReplyType = msg.MessageType
+	call.Reply = msg.Message
+	call.Remote = remote
+	close(call.replied)
+	call.Done <- call
+}
+
+// finishCall completes the call with an error, if it hasn't already been completed
+func (dht *Kademlia) finishCall(call *Call, err error) {
+	token := call.Message.Token
+	dht.lock.Lock()
+	if dht.calls[token] != call {
+		dht.lock.Unlock()
+		return
+	}
+	delete(dht.calls, token)
+	delete(dht.awaitingResponse, token)
+	dht.lock.Unlock()
+
+	call.Error = err
+	call.Done <- call
+}
+
+// sweep clears out tokens that have been waiting for too long, as well as anything else registered with them
+func (dht *Kademlia) sweep() {
+	dht.lock.Lock()
+	defer dht.lock.Unlock()
+
+	for token, t := range dht.awaitingResponse {
+		if _, isCall := dht.calls[token]; isCall {
+			continue // calls time themselves out, so this is only for the tokens registered by hand
+		}
+		if since(t) > TOKEN_TTL {
+			delete(dht.awaitingResponse, token)
+		}
+	}
+
+	// anything that's not awaiting a response any more is garbage. But the handlers of a call's response may still
+	// need it for a little while, so it's only swept if it was already garbage on the previous sweep
+	orphans := make(map[string]bool)
+	for token := range dht.extraInfo {
+		if _, ok := dht.awaitingResponse[token]; ok {
+			continue
+		}
+		if dht.orphans[token] {
+			delete(dht.extraInfo, token)
+			continue
+		}
+		orphans[token] = true
+	}
+	dht.orphans = orphans
+}
@@ -0,0 +1,63 @@
+package kademlia
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// a second call on a token that's still waiting is refused, and the first still times out on its own
+func TestCallTokenInUse(t *testing.T) {
+	_, nodes := newTestNetwork(t, 1, 4)
+	k := nodes[0]
+	nowhere := &net.UDPAddr{IP: net.IPv4(10, 9, 9, 9), Port: 1000}
+
+	message, token := NewMessage()
+	message.MessageType = "PING"
+	message.SourceID = k.Node.ID
+
+	first := k.Go(context.Background(), nowhere, message)
+	second := <-k.Go(context.Background(), nowhere, message).Done
+	if second.Error != ErrTokenInUse {
+		t.Fatalf("expected ErrTokenInUse. Got %v", second.Error)
+	}
+
+	select {
+	case call := <-first.Done:
+		timeout, ok := call.Error.(*TimeoutError)
+		if !ok || timeout.Token != token {
+			t.Fatalf("expected the first call to time out. Got %v", call.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first call never finished")
+	}
+}
+
+// a call is only answered by the message types that answer its request, not by anything with the same token
+func TestCallMatchesReplyType(t *testing.T) {
+	_, nodes := newTestNetwork(t, 2, 5)
+	a, b := nodes[0], nodes[1]
+	a.Expect("ASK", "ANSWER")
+
+	b.Handle("ASK", func(remote *RemoteNode, token string, source NodeID, data interface{}) {
+		for _, messageType := range []string{"ASK", "ASK_RESPONSE", "SOMETHING_ELSE", "ANSWER"} {
+			message, _ := NewMessage()
+			message.MessageType = messageType
+			message.SourceID = b.Node.ID
+			message.Token = token
+			SendMsg(b.Transport, remote.Address, message)
+		}
+	})
+
+	message, _ := NewMessage()
+	message.MessageType = "ASK"
+	message.SourceID = a.Node.ID
+	call, err := a.Call(context.Background(), b.Transport.LocalAddr(), message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call.ReplyType != "ANSWER" {
+		t.Errorf("the call was answered by %s", call.ReplyType)
+	}
+}
@@ -0,0 +1,99 @@
+package kademlia
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// contact is what gets saved of a remote node
+type contact struct {
+	ID       NodeID
+	Address  string
+	LastSeen time.Time
+}
+
+// state is what gets saved to disk, so that a restarted node keeps its identity and knows who to talk to
+type state struct {
+	ID       NodeID
+	Contacts []contact
+	Saved    time.Time
+}
+
+// SaveState writes the node ID and a snapshot of the routing table to the file.
+// The file is written in full before it replaces the old one, so a crash halfway won't lose the old state
+func (node *Node) SaveState(filename string) error {
+	s := state{ID: node.ID, Saved: now()}
+	for _, r := range node.Contacts() {
+		s.Contacts = append(s.Contacts, contact{ID: r.ID, Address: r.Address.String(), LastSeen: r.LastResponded()})
+	}
+
+	b, err := msgpack.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// LoadState reads the node ID back from the file, and returns the saved contacts. The contacts are not put in the
+// routing table - they may well be dead by now. Pass them to Rejoin instead.
+// This has to be called before the node goes on the network, as the node ID changes.
+// A missing file is not an error: it just means this is the first run, so the node keeps its fresh random ID
+func (node *Node) LoadState(filename string) ([]*RemoteNode, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s state
+	if err := msgpack.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+
+	if len(s.ID) == ID_SIZE {
+		node.ID = s.ID
+	}
+
+	var contacts []*RemoteNode
+	for _, c := range s.Contacts {
+		addr, err := net.ResolveUDPAddr("udp", c.Address)
+		if err != nil || len(c.ID) != ID_SIZE {
+			continue
+		}
+		contacts = append(contacts, &RemoteNode{ID: c.ID, Address: addr, lastResponded: c.LastSeen})
+	}
+	return contacts, nil
+}
+
+// Rejoin bootstraps off the saved contacts. The ones that respond go back into the routing table the usual way.
+// The number of contacts that responded is returned
+func (dht *Kademlia) Rejoin(ctx context.Context, contacts []*RemoteNode) int {
+	addrs := make([]*net.UDPAddr, 0, len(contacts))
+	for _, r := range contacts {
+		addrs = append(addrs, r.Address)
+	}
+	return dht.bootstrap(ctx, addrs)
+}
+
+// saveState is the periodic save, if there's somewhere to save to
+func (dht *Kademlia) saveState() {
+	if dht.StateFile == "" {
+		return
+	}
+	if err := dht.Node.SaveState(dht.StateFile); err != nil {
+		log.Printf("Unable to save state to %s. Error was: %s", dht.StateFile, err)
+	}
+}
@@ -0,0 +1,195 @@
+package kademlia
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	RECORD_TTL         = 24 * time.Hour // records that haven't been republished by their publisher for this long expire
+	REPUBLISH_INTERVAL = time.Hour      // publishers republish their records this often
+	REPLICATE_INTERVAL = time.Hour      // nodes holding someone else's record replicate it this often
+)
+
+// a record is one provider's entry under a key: the value it announced, who it is, and when it last announced it.
+// A key can have any number of records, one per provider, and each of them expires on its own.
+// This is also what gets sent in a STORE
+type record struct {
+	Key       string
+	Value     interface{}
+	Publisher NodeID
+	Address   *net.UDPAddr // where the publisher can be reached. Nil if nobody has seen the publisher send it
+	Published time.Time
+
+	stored time.Time // when this node last received or replicated it
+}
+
+func (r record) expired() bool { return since(r.Published) > RECORD_TTL }
+
+// Provider is a node that has announced a key, along with the value it announced
+type Provider struct {
+	ID        NodeID
+	Address   *net.UDPAddr
+	Value     interface{}
+	Published time.Time
+}
+
+func (r record) provider() Provider {
+	return Provider{ID: r.Publisher, Address: r.Address, Value: r.Value, Published: r.Published}
+}
+
+// Put stores a value locally, with this node as the provider. It will be republished every hour for as long as this node lives.
+// Putting again under the same key replaces this node's value, but leaves the other providers alone
+func (node *Node) Put(key string, value interface{}) {
+	node.putRecord(record{Key: key, Value: value, Publisher: node.ID, Published: now()})
+}
+
+// Get retrieves the locally stored providers of a key
+func (node *Node) Get(key string) (providers []Provider, ok bool) {
+	for _, r := range node.getRecords(key) {
+		providers = append(providers, r.provider())
+	}
+	return providers, len(providers) > 0
+}
+
+// putRecord stores the record, unless a more recently published one from the same provider is already there
+func (node *Node) putRecord(r record) bool {
+	return node.put(r, false)
+}
+
+// putReplica stores a record that was sent by someone other than its publisher. Only the publisher can refresh a record,
+// so a replica that claims to be newer than what's already here (or to be from the future) is turned down
+func (node *Node) putReplica(r record) bool {
+	return node.put(r, true)
+}
+
+func (node *Node) put(r record, replica bool) bool {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if replica && r.Published.After(now()) {
+		return false
+	}
+
+	providers, ok := node.store[r.Key]
+	if !ok {
+		providers = make(map[string]record)
+		node.store[r.Key] = providers
+	}
+
+	if old, ok := providers[string(r.Publisher)]; ok {
+		if old.Published.After(r.Published) || (replica && r.Published.After(old.Published)) {
+			return false
+		}
+		if r.Address == nil {
+			r.Address = old.Address // don't forget where the provider is just because the replicating node didn't know
+		}
+	}
+	r.stored = now()
+	providers[string(r.Publisher)] = r
+	return true
+}
+
+// getRecords returns all the live records of a key. Expired records that aren't ours are hidden
+func (node *Node) getRecords(key string) []record {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+
+	var retVal []record
+	for _, r := range node.store[key] {
+		if r.expired() && !r.Publisher.EqualsTo(node.ID) {
+			continue
+		}
+		retVal = append(retVal, r)
+	}
+	return retVal
+}
+
+// records returns a snapshot of everything in the store
+func (node *Node) records() []record {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+
+	var retVal []record
+	for _, providers := range node.store {
+		for _, r := range providers {
+			retVal = append(retVal, r)
+		}
+	}
+	return retVal
+}
+
+// ExpireRecords removes the records whose providers have stopped republishing them. Our own records never expire
+func (node *Node) ExpireRecords() {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	for k, providers := range node.store {
+		for id, r := range providers {
+			if r.expired() && !r.Publisher.EqualsTo(node.ID) {
+				delete(providers, id)
+			}
+		}
+		if len(providers) == 0 {
+			delete(node.store, k)
+		}
+	}
+}
+
+// LocalStore basically stores data in the local node, with this node as the provider
+func (dht *Kademlia) LocalStore(key string, value interface{}) {
+	dht.Node.Put(key, value)
+}
+
+// Publish announces this node as a provider of the key: the value is stored locally, and on the K closest nodes to the key.
+// Other providers of the same key are unaffected. The number of nodes that stored it is returned
+func (dht *Kademlia) Publish(ctx context.Context, key string, value interface{}) int {
+	dht.Node.Put(key, value)
+	for _, r := range dht.Node.getRecords(key) {
+		if r.Publisher.EqualsTo(dht.Node.ID) {
+			return dht.replicate(ctx, r)
+		}
+	}
+	return 0
+}
+
+// replicate stores the record on the K closest nodes to its key
+func (dht *Kademlia) replicate(ctx context.Context, r record) int {
+	var calls []*Call
+	for _, remote := range dht.FindNode(ctx, KeyID(r.Key)) {
+		calls = append(calls, dht.storeRecord(ctx, remote, r))
+	}
+
+	stored := 0
+	for _, call := range calls {
+		if c := <-call.Done; c.Error == nil {
+			stored++
+		}
+	}
+	return stored
+}
+
+// republish goes through the store. Our own records are republished every hour with a fresh timestamp.
+// Everyone else's are replicated as is every hour, unless someone else has already stored it here within the hour
+func (dht *Kademlia) republish() {
+	ctx := context.Background()
+	for _, r := range dht.Node.records() {
+		switch {
+		case r.Publisher.EqualsTo(dht.Node.ID):
+			if since(r.Published) < REPUBLISH_INTERVAL {
+				continue
+			}
+			r.Published = now()
+		case r.expired():
+			continue
+		case since(r.stored) < REPLICATE_INTERVAL:
+			continue
+		}
+
+		dht.Node.putRecord(r)
+		n := dht.replicate(ctx, r)
+		log.Printf("Republished %s to %d nodes", r.Key, n)
+	}
+}
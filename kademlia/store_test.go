@@ -0,0 +1,53 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReplicasCantRefresh(t *testing.T) {
+	node := NewNode()
+	publisher := newNodeID()
+
+	published := now().Add(-time.Hour)
+	if !node.putReplica(record{Key: "room", Publisher: publisher, Published: published}) {
+		t.Fatal("a replica of a record we don't have should be taken")
+	}
+	if node.putReplica(record{Key: "room", Publisher: publisher, Published: published.Add(time.Minute)}) {
+		t.Error("a replica claiming to be newer than ours should be turned down")
+	}
+	if !node.putReplica(record{Key: "room", Publisher: publisher, Published: published}) {
+		t.Error("the same replica again should be taken")
+	}
+	if node.putReplica(record{Key: "other room", Publisher: publisher, Published: now().Add(time.Hour)}) {
+		t.Error("a replica from the future should be turned down")
+	}
+	if !node.putRecord(record{Key: "room", Publisher: publisher, Published: now()}) {
+		t.Error("the publisher should be able to refresh its record")
+	}
+}
+
+func TestStoreOfOurOwnRecordsIsDiscarded(t *testing.T) {
+	_, nodes := newTestNetwork(t, 2, 3)
+	ctx := context.Background()
+	forger, victim := nodes[0], nodes[1]
+
+	remote := forger.Node.GetNode(victim.Node.ID)
+	if remote == nil {
+		t.Fatal("the forger doesn't know the victim")
+	}
+	forged := record{Key: "room", Value: "forged", Publisher: victim.Node.ID, Published: now()}
+	<-forger.storeRecord(ctx, remote, forged).Done
+
+	// and a replica of someone else's record makes it through
+	replica := record{Key: "room", Value: "replica", Publisher: newNodeID(), Published: now()}
+	if call := <-forger.storeRecord(ctx, remote, replica).Done; call.Error != nil {
+		t.Fatal(call.Error)
+	}
+
+	providers, _ := victim.Node.Get("room")
+	if len(providers) != 1 || providers[0].Value != "replica" {
+		t.Fatalf("expected just the replica to be stored. Got %v", providers)
+	}
+}
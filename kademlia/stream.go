@@ -0,0 +1,399 @@
+package kademlia
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// streams: each peer gets one persistent TCP connection, on the same port number as the peer's UDP transport.
+// A connection starts with the dialer's port (2 bytes), so the other side knows where the dialer listens and can use the same
+// connection to talk back. The port is only taken once the dialer's shown it really listens there: the other side sends a
+// check (STREAM_CHECK_MAGIC followed by a nonce) to that port over the fallback transport, and the dialer sends the nonce
+// back as the stream's first frame. After that, it's all frames: a 4 byte length followed by the message. Empty frames are
+// keepalives. Everything's big endian
+const (
+	STREAM_DIAL_TIMEOUT = 5 * time.Second
+	KEEPALIVE_INTERVAL  = 30 * time.Second       // the default for how often a keepalive goes down an idle stream
+	STREAM_IDLE_TIMEOUT = 3 * KEEPALIVE_INTERVAL // the default for how long a stream can go with nothing coming through before it's dropped
+	MIN_BACKOFF         = time.Second            // after a failed dial, the address is left alone for this long. This doubles with every failure
+	MAX_BACKOFF         = 5 * time.Minute
+	STREAM_CHECK_MAGIC  = 0x53 // 'S'. Datagrams that start with this and are followed by a nonce are stream checks, not messages
+	STREAM_NONCE_SIZE   = 16
+)
+
+var (
+	errStreamClosed = errors.New("stream closed")
+	errNoCheck      = errors.New("the other side never sent a stream check")
+)
+
+type streamConn struct {
+	net.Conn
+	addr *net.UDPAddr // where the peer listens
+
+	writeLock sync.Mutex
+}
+
+// writeFrame writes a length prefixed frame. An empty one is a keepalive
+func (c *streamConn) writeFrame(b []byte) error {
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.SetWriteDeadline(time.Now().Add(STREAM_DIAL_TIMEOUT))
+	_, err := c.Write(frame)
+	return err
+}
+
+type backoff struct {
+	delay time.Duration
+	until time.Time
+}
+
+type received struct {
+	b    []byte
+	from *net.UDPAddr
+}
+
+// StreamTransport sends messages over persistent TCP connections, one per peer, so they're not lost the way datagrams are.
+// Whenever a stream can't be had, it falls back to the fallback transport - so talking to peers that don't do streams still works.
+// Streams are dialed in the background, so sending never waits on a dial: until the stream's up, messages go over the fallback.
+// Messages that come in on the fallback transport are received as well
+type StreamTransport struct {
+	fallback Transport
+	listener net.Listener
+	port     int
+
+	MaxMessageSize    int
+	KeepaliveInterval time.Duration // how often a keepalive goes down a stream. This and IdleTimeout are read under the lock
+	IdleTimeout       time.Duration // streams that haven't had anything come through for this long are dropped
+
+	conns    map[string]*streamConn // key is where the peer listens
+	backoffs map[string]*backoff    // same key. Addresses that failed to dial recently
+	dialing  map[string]chan []byte // same key. Dials that are going on, waiting for the other side's check
+
+	incoming chan received
+	closed   chan struct{}
+	once     sync.Once
+	lock     sync.Mutex
+}
+
+// NewStreamTransport listens for streams on the TCP port, falling back to the fallback transport
+func NewStreamTransport(port int, fallback Transport) (*StreamTransport, error) {
+	listener, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &StreamTransport{
+		fallback: fallback,
+		listener: listener,
+		port:     listener.Addr().(*net.TCPAddr).Port,
+
+		MaxMessageSize:    MAX_MESSAGE_SIZE,
+		KeepaliveInterval: KEEPALIVE_INTERVAL,
+		IdleTimeout:       STREAM_IDLE_TIMEOUT,
+
+		conns:    make(map[string]*streamConn),
+		backoffs: make(map[string]*backoff),
+		dialing:  make(map[string]chan []byte),
+
+		incoming: make(chan received),
+		closed:   make(chan struct{}),
+	}
+	go t.accept()
+	go t.pumpFallback()
+	return t, nil
+}
+
+func (t *StreamTransport) Send(b []byte, addr *net.UDPAddr) error {
+	if c := t.stream(addr); c != nil {
+		if err := c.writeFrame(b); err == nil {
+			return nil
+		}
+		t.drop(c)
+	}
+	return t.fallback.Send(b, addr)
+}
+
+func (t *StreamTransport) Receive() ([]byte, *net.UDPAddr, error) {
+	select {
+	case r := <-t.incoming:
+		return r.b, r.from, nil
+	case <-t.closed:
+		return nil, nil, errStreamClosed
+	}
+}
+
+func (t *StreamTransport) LocalAddr() *net.UDPAddr { return t.fallback.LocalAddr() }
+
+func (t *StreamTransport) Close() error {
+	t.once.Do(func() {
+		close(t.closed)
+		t.listener.Close()
+
+		t.lock.Lock()
+		for _, c := range t.conns {
+			c.Close()
+		}
+		t.lock.Unlock()
+
+		t.fallback.Close()
+	})
+	return nil
+}
+
+// stream gets the stream to the address. If there isn't one, a dial is started in the background (unless there's one going
+// already, or the address is being backed off from) and nil is returned
+func (t *StreamTransport) stream(addr *net.UDPAddr) *streamConn {
+	key := addr.String()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if c, ok := t.conns[key]; ok {
+		return c
+	}
+	if _, ok := t.dialing[key]; ok {
+		return nil
+	}
+	if b, ok := t.backoffs[key]; ok && time.Now().Before(b.until) {
+		return nil
+	}
+
+	check := make(chan []byte, 1)
+	t.dialing[key] = check
+	go t.dial(addr, check)
+	return nil
+}
+
+// dial opens a stream to the address, and keeps it if the other side's check comes back. Failures are backed off from
+func (t *StreamTransport) dial(addr *net.UDPAddr, check chan []byte) {
+	key := addr.String()
+	c, err := t.open(addr, check)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.dialing, key)
+
+	if err != nil {
+		b, ok := t.backoffs[key]
+		if !ok {
+			b = &backoff{delay: MIN_BACKOFF}
+			t.backoffs[key] = b
+		} else if b.delay *= 2; b.delay > MAX_BACKOFF {
+			b.delay = MAX_BACKOFF
+		}
+		b.until = time.Now().Add(b.delay)
+		log.Printf("No stream to %s, backing off for %s. Error was: %s", key, b.delay, err)
+		return
+	}
+	delete(t.backoffs, key)
+
+	select {
+	case <-t.closed:
+		c.Close()
+		return
+	default:
+	}
+	if _, ok := t.conns[key]; ok {
+		c.Close() // they dialed us while we were dialing them
+		return
+	}
+	t.add(c)
+}
+
+// open dials the address, says where we listen, and answers the check the other side sends there
+func (t *StreamTransport) open(addr *net.UDPAddr, check chan []byte) (*streamConn, error) {
+	conn, err := net.DialTimeout("tcp4", addr.String(), STREAM_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	c := &streamConn{Conn: conn, addr: addr}
+
+	var hello [2]byte
+	binary.BigEndian.PutUint16(hello[:], uint16(t.port))
+	conn.SetWriteDeadline(time.Now().Add(STREAM_DIAL_TIMEOUT))
+	if _, err = conn.Write(hello[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	select {
+	case nonce := <-check:
+		if err = c.writeFrame(nonce); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return c, nil
+	case <-time.After(STREAM_DIAL_TIMEOUT):
+		err = errNoCheck
+	case <-t.closed:
+		err = errStreamClosed
+	}
+	conn.Close()
+	return nil, err
+}
+
+// add registers the stream and starts reading from it. It's called with the lock held
+func (t *StreamTransport) add(c *streamConn) {
+	if old, ok := t.conns[c.addr.String()]; ok {
+		old.Close() // the peer reconnected. The old one's dead, or soon will be
+	}
+	t.conns[c.addr.String()] = c
+	go t.read(c, t.IdleTimeout)
+	go t.keepalive(c, t.KeepaliveInterval)
+}
+
+func (t *StreamTransport) drop(c *streamConn) {
+	t.lock.Lock()
+	if t.conns[c.addr.String()] == c {
+		delete(t.conns, c.addr.String())
+	}
+	t.lock.Unlock()
+	c.Close()
+}
+
+func (t *StreamTransport) accept() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.closed:
+			default:
+				log.Printf("Unable to accept streams any more. Error was: %s", err)
+			}
+			return
+		}
+		go t.handshake(conn)
+	}
+}
+
+// handshake reads the dialer's port, which is what the stream is known by from then on. Anyone can claim any port, so
+// before it's taken a nonce is sent there over the fallback transport, and the dialer has to send it back down the stream.
+// Otherwise a dialer could take over the stream of someone else behind the same IP
+func (t *StreamTransport) handshake(conn net.Conn) {
+	var hello [2]byte
+	conn.SetReadDeadline(time.Now().Add(STREAM_DIAL_TIMEOUT))
+	if _, err := io.ReadFull(conn, hello[:]); err != nil {
+		conn.Close()
+		return
+	}
+
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	addr := &net.UDPAddr{IP: remote.IP, Port: int(binary.BigEndian.Uint16(hello[:]))}
+
+	check := make([]byte, 1+STREAM_NONCE_SIZE)
+	check[0] = STREAM_CHECK_MAGIC
+	rand.Read(check[1:])
+	if err := t.fallback.Send(check, addr); err != nil {
+		conn.Close()
+		return
+	}
+
+	answer := make([]byte, 4+STREAM_NONCE_SIZE)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		log.Printf("DROPPED STREAM from %s: no answer to the check sent to %s", remote, addr)
+		conn.Close()
+		return
+	}
+	if binary.BigEndian.Uint32(answer) != STREAM_NONCE_SIZE || subtle.ConstantTimeCompare(answer[4:], check[1:]) != 1 {
+		log.Printf("DROPPED STREAM from %s: it claimed to listen on %s, but didn't answer the check sent there", remote, addr)
+		conn.Close()
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	select {
+	case <-t.closed:
+		conn.Close()
+		return
+	default:
+	}
+	t.add(&streamConn{Conn: conn, addr: addr})
+}
+
+func (t *StreamTransport) read(c *streamConn, idle time.Duration) {
+	defer t.drop(c)
+
+	var header [4]byte
+	for {
+		c.SetReadDeadline(time.Now().Add(idle))
+		if _, err := io.ReadFull(c, header[:]); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size == 0 {
+			continue // keepalive
+		}
+		if size > uint32(t.MaxMessageSize) {
+			log.Printf("DROPPED STREAM from %s: %d byte message is too big", c.addr, size)
+			return
+		}
+
+		b := make([]byte, size)
+		if _, err := io.ReadFull(c, b); err != nil {
+			return
+		}
+
+		select {
+		case t.incoming <- received{b, c.addr}:
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+func (t *StreamTransport) keepalive(c *streamConn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.writeFrame(nil); err != nil {
+				t.drop(c)
+				return
+			}
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+// pumpFallback passes on whatever comes in on the fallback transport. Stream checks go to the dial they're for instead
+func (t *StreamTransport) pumpFallback() {
+	for {
+		b, from, err := t.fallback.Receive()
+		if err != nil {
+			return
+		}
+		if len(b) == 1+STREAM_NONCE_SIZE && b[0] == STREAM_CHECK_MAGIC {
+			t.lock.Lock()
+			check, ok := t.dialing[from.String()]
+			t.lock.Unlock()
+			if ok {
+				select {
+				case check <- b[1:]:
+				default: // it's already got one
+				}
+			}
+			continue
+		}
+
+		select {
+		case t.incoming <- received{b, from}:
+		case <-t.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package kademlia
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// newUDPPeer listens for UDP on a free port. It's a peer that doesn't do streams, or the fallback for one that does
+func newUDPPeer(t *testing.T) *UDPTransport {
+	udp, err := NewUDPTransport(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	return udp
+}
+
+// newStreamPeer is a stream transport over UDP, with streams on the same port number, the way the client sets one up
+func newStreamPeer(t *testing.T) *StreamTransport {
+	for i := 0; i < 10; i++ {
+		udp := newUDPPeer(t)
+		s, err := NewStreamTransport(udp.LocalAddr().Port, udp)
+		if err != nil {
+			continue // the TCP port's taken. Try another
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	t.Fatal("unable to find a port that's free for both UDP and TCP")
+	return nil
+}
+
+// loopback is where a transport can be reached in the tests
+func loopback(t Transport) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: t.LocalAddr().Port}
+}
+
+func setStreamTimeouts(t *StreamTransport, keepalive, idle time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.KeepaliveInterval = keepalive
+	t.IdleTimeout = idle
+}
+
+// connTo is the stream the transport has to the address, if there is one
+func connTo(t *StreamTransport, addr *net.UDPAddr) *streamConn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.conns[addr.String()]
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !f(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func expectMessage(t *testing.T, r Transport, want string, from *net.UDPAddr) {
+	type result struct {
+		b    []byte
+		from *net.UDPAddr
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		b, from, err := r.Receive()
+		done <- result{b, from, err}
+	}()
+
+	select {
+	case got := <-done:
+		if got.err != nil {
+			t.Fatal(got.err)
+		}
+		if string(got.b) != want || got.from.String() != from.String() {
+			t.Fatalf("expected %q from %s. Got %q from %s", want, from, got.b, got.from)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%q never came", want)
+	}
+}
+
+// the first message goes over UDP while the stream's dialed, the ones after down the stream, and replies come back up it
+func TestStreamHandshake(t *testing.T) {
+	a, b := newStreamPeer(t), newStreamPeer(t)
+
+	if err := a.Send([]byte("over udp"), loopback(b)); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, b, "over udp", loopback(a))
+	waitFor(t, "a's stream to b", func() bool { return connTo(a, loopback(b)) != nil })
+	waitFor(t, "b to take a's stream", func() bool { return connTo(b, loopback(a)) != nil })
+
+	if err := a.Send([]byte("down the stream"), loopback(b)); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, b, "down the stream", loopback(a))
+
+	if err := b.Send([]byte("back up it"), loopback(a)); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, a, "back up it", loopback(b))
+
+	b.lock.Lock()
+	dialed := len(b.dialing) + len(b.backoffs)
+	b.lock.Unlock()
+	if dialed != 0 {
+		t.Error("b dialed a instead of using the stream a opened")
+	}
+}
+
+// a dialer that says it listens on someone else's port can't answer the check sent there, and its stream isn't taken
+func TestStreamHandshakeChecksPort(t *testing.T) {
+	b := newStreamPeer(t)
+	victim := newUDPPeer(t)
+
+	checked := make(chan []byte, 1)
+	go func() {
+		if c, _, err := victim.Receive(); err == nil {
+			checked <- c
+		}
+	}()
+
+	conn, err := net.Dial("tcp4", loopback(b).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var hello [2]byte
+	binary.BigEndian.PutUint16(hello[:], uint16(victim.LocalAddr().Port))
+	conn.Write(hello[:])
+
+	select {
+	case c := <-checked:
+		if len(c) != 1+STREAM_NONCE_SIZE || c[0] != STREAM_CHECK_MAGIC {
+			t.Fatalf("expected a stream check at the claimed port. Got %x", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no check was sent to the claimed port")
+	}
+
+	// a guess at the nonce, and then a message
+	guess := make([]byte, 4+STREAM_NONCE_SIZE)
+	binary.BigEndian.PutUint32(guess, STREAM_NONCE_SIZE)
+	conn.Write(guess)
+	conn.Write([]byte{0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err, ok := err.(net.Error); err == nil || ok && err.Timeout() {
+		t.Fatalf("expected the stream to be closed. Got %v", err)
+	}
+	if connTo(b, loopback(victim)) != nil {
+		t.Fatal("the stream was taken as the victim's")
+	}
+}
+
+func TestStreamKeepalive(t *testing.T) {
+	t.Run("keepalives keep an idle stream up", func(t *testing.T) {
+		a, b := newStreamPeer(t), newStreamPeer(t)
+		setStreamTimeouts(a, 10*time.Millisecond, 50*time.Millisecond)
+		setStreamTimeouts(b, 10*time.Millisecond, 50*time.Millisecond)
+
+		a.Send([]byte("hi"), loopback(b))
+		waitFor(t, "the stream", func() bool { return connTo(b, loopback(a)) != nil })
+		ab, ba := connTo(a, loopback(b)), connTo(b, loopback(a))
+
+		time.Sleep(300 * time.Millisecond)
+		if connTo(a, loopback(b)) != ab || connTo(b, loopback(a)) != ba {
+			t.Fatal("the stream was dropped, keepalives and all")
+		}
+	})
+
+	t.Run("a stream without them is dropped", func(t *testing.T) {
+		a, b := newStreamPeer(t), newStreamPeer(t)
+		setStreamTimeouts(a, time.Hour, time.Hour)
+		setStreamTimeouts(b, time.Hour, 50*time.Millisecond)
+
+		a.Send([]byte("hi"), loopback(b))
+		waitFor(t, "the stream", func() bool { return connTo(b, loopback(a)) != nil })
+		waitFor(t, "b to drop the idle stream", func() bool { return connTo(b, loopback(a)) == nil })
+		waitFor(t, "a to see it's gone", func() bool { return connTo(a, loopback(b)) == nil })
+	})
+}
+
+// a peer that doesn't do streams still gets everything over UDP, and is backed off from for longer with every failed dial
+func TestStreamFallbackAndBackoff(t *testing.T) {
+	a := newStreamPeer(t)
+	udp := newUDPPeer(t)
+	key := loopback(udp).String()
+
+	backoff := func() time.Duration {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if b, ok := a.backoffs[key]; ok {
+			return b.delay
+		}
+		return 0
+	}
+	// retry forgets that the address is being backed off from, and sends again
+	retry := func(want time.Duration) {
+		a.lock.Lock()
+		a.backoffs[key].until = time.Time{}
+		a.lock.Unlock()
+		a.Send([]byte("again"), loopback(udp))
+		expectMessage(t, udp, "again", loopback(a))
+		waitFor(t, "the backoff to grow", func() bool { return backoff() == want })
+	}
+
+	if err := a.Send([]byte("hi"), loopback(udp)); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, udp, "hi", loopback(a))
+	waitFor(t, "the failed dial", func() bool { return backoff() == MIN_BACKOFF })
+
+	// no dial while it's backed off
+	a.Send([]byte("still here"), loopback(udp))
+	expectMessage(t, udp, "still here", loopback(a))
+	a.lock.Lock()
+	dialing := len(a.dialing)
+	a.lock.Unlock()
+	if dialing != 0 {
+		t.Fatal("dialed an address that's being backed off from")
+	}
+
+	retry(2 * MIN_BACKOFF)
+	a.lock.Lock()
+	a.backoffs[key].delay = MAX_BACKOFF * 3 / 4
+	a.lock.Unlock()
+	retry(MAX_BACKOFF) // and no more
+
+	// once the peer does do streams, the next dial gets one and the backoff's forgotten
+	b, err := NewStreamTransport(udp.LocalAddr().Port, udp)
+	if err != nil {
+		t.Skipf("the TCP port's taken: %s", err)
+	}
+	defer b.Close()
+	a.lock.Lock()
+	a.backoffs[key].until = time.Time{}
+	a.lock.Unlock()
+	a.Send([]byte("hi again"), loopback(udp))
+	expectMessage(t, b, "hi again", loopback(a))
+	waitFor(t, "the stream", func() bool { return connTo(a, loopback(udp)) != nil })
+	if backoff() != 0 {
+		t.Error("the backoff wasn't forgotten")
+	}
+}
+
+// sending never waits on a dial - not even one to a peer that takes the connection and then says nothing
+func TestStreamSendDoesNotWaitOnDial(t *testing.T) {
+	a := newStreamPeer(t)
+	udp := newUDPPeer(t)
+	listener, err := net.Listen("tcp4", loopback(udp).String())
+	if err != nil {
+		t.Skipf("the TCP port's taken: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := a.Send([]byte("hi"), loopback(udp)); err != nil {
+			t.Fatal(err)
+		}
+		expectMessage(t, udp, "hi", loopback(a))
+	}
+	if elapsed := time.Since(start); elapsed > STREAM_DIAL_TIMEOUT/2 {
+		t.Fatalf("sending took %s", elapsed)
+	}
+
+	// the first one's dial is still waiting on its check
+	a.lock.Lock()
+	_, dialing := a.dialing[loopback(udp).String()]
+	a.lock.Unlock()
+	if !dialing {
+		t.Error("expected a dial to be going on")
+	}
+}
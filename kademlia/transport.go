@@ -0,0 +1,54 @@
+package kademlia
+
+import (
+	"fmt"
+	"net"
+)
+
+// Transport is what the DHT sends and receives packets with. Addresses are UDP addresses regardless of the transport,
+// since that's what RemoteNodes are addressed by - transports that aren't actually UDP just use them as names
+type Transport interface {
+	// Send sends a packet to the address. Like UDP, there's no guarantee it arrives
+	Send(b []byte, addr *net.UDPAddr) error
+
+	// Receive blocks until a packet arrives. An error means the transport is done for - usually because it was closed
+	Receive() (b []byte, from *net.UDPAddr, err error)
+
+	LocalAddr() *net.UDPAddr
+	Close() error
+}
+
+const MAX_DATAGRAM_SIZE = 65535 // the most a UDP datagram can hold
+
+// UDPTransport is a Transport over a real UDP socket. Messages are limited to what fits in a datagram - wrap it in a
+// FramedTransport for anything bigger
+type UDPTransport struct {
+	conn *net.UDPConn
+}
+
+// NewUDPTransport listens on the port, on all interfaces
+func NewUDPTransport(port int) (*UDPTransport, error) {
+	listener, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return &UDPTransport{conn: listener.(*net.UDPConn)}, nil
+}
+
+func (t *UDPTransport) Send(b []byte, addr *net.UDPAddr) error {
+	_, err := t.conn.WriteToUDP(b, addr)
+	return err
+}
+
+func (t *UDPTransport) Receive() ([]byte, *net.UDPAddr, error) {
+	var b []byte = make([]byte, MAX_DATAGRAM_SIZE)
+	n, addr, err := t.conn.ReadFromUDP(b)
+	return b[:n], addr, err
+}
+
+func (t *UDPTransport) LocalAddr() *net.UDPAddr {
+	addr, _ := t.conn.LocalAddr().(*net.UDPAddr)
+	return addr
+}
+
+func (t *UDPTransport) Close() error { return t.conn.Close() }
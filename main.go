@@ -5,32 +5,47 @@ import (
 	"github.com/kr/pretty"
 
 	"bufio"
+	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 
 	"crypto/rsa"
+	"crypto/x509"
 )
 
 type client struct {
 	Node    *kademlia.Node
 	Network *kademlia.Kademlia
 
-	port       int
-	connection *net.UDPConn
+	port      int
+	transport kademlia.Transport
+	stateFile string // where the node ID and routing table are kept between runs
 
 	packets  chan packet
-	messages chan Message
+	messages chan envelope
 	kill     chan bool
 
 	ui chan string
 
-	privateKey    *rsa.PrivateKey
+	awaitingAck map[string]chan struct{} // key is message ID/participant. Closed when the participant acks
+	ackLock     sync.Mutex
+
+	inviteRequests map[string]pendingInvite // key is request ID. Waiting on approve or deny. See invites.go
+	inviteLock     sync.Mutex
+
+	privateKey      *rsa.PrivateKey // who we are. See identity.go
+	identity        []byte          // the public half, DER encoded
+	defaultNickname string
+
 	chatroomsID   map[string]*chatroom
 	chatroomsName map[string]*chatroom
+	roomsLock     sync.Mutex // the input loop, the handshake handlers and processMessages all get at the rooms at once
 }
 
 func newClient() *client {
@@ -38,11 +53,14 @@ func newClient() *client {
 		Node: kademlia.NewNode(),
 
 		packets:  make(chan packet),
-		messages: make(chan Message),
+		messages: make(chan envelope),
 		kill:     make(chan bool),
 
 		ui: make(chan string),
 
+		awaitingAck:    make(map[string]chan struct{}),
+		inviteRequests: make(map[string]pendingInvite),
+
 		chatroomsID:   make(map[string]*chatroom),
 		chatroomsName: make(map[string]*chatroom),
 	}
@@ -67,10 +85,9 @@ func (c *client) inputloop() {
 			c.connectToNetwork(argAddr)
 		case "nodes":
 			c.ui <- "Nodes"
-			for i, bucket := range c.Node.RoutingTable {
+			for i, bucket := range c.Node.Buckets() {
 				c.ui <- fmt.Sprintf("\tBucket Number: %d", i)
-				for elem := bucket.Front(); elem != nil; elem = elem.Next() {
-					r, _ := elem.Value.(*kademlia.RemoteNode)
+				for _, r := range bucket {
 					c.ui <- fmt.Sprintf("\t\tID: %v\n\t\tAddr: %s\n\t\t===", r.ID, r.Address)
 				}
 			}
@@ -88,38 +105,32 @@ func (c *client) inputloop() {
 			argName = strings.TrimSpace(argName)
 
 			c.ui <- "...Generating Chatroom..."
-			chatRoom := createChatroom()
-			chatRoom.Name = argName
-			c.chatroomsID[chatRoom.ID] = chatRoom
-			c.chatroomsName[argName] = chatRoom
-
-			// add own address to participants
-			c.ui <- "...Updating Chatroom..."
-			lA := c.connection.LocalAddr()
-			localAddr, _ := lA.(*net.UDPAddr)
-			chatRoom.participants[string(c.Node.ID)] = localAddr
-
-			chatRoom.ExportKeys()
+			chatRoom := c.NewRoom(argName)
 
 			// store room ID in the kademlia network so that people can find the room
-			c.Network.LocalStore(chatRoom.ID, c.Node.ID)
+			go c.announceRoom(chatRoom.ID)
 
 			c.ui <- fmt.Sprintf("...Chatroom Created. \nID: %s. \nUser Friendly Name: %s\nThe keys to this room are: chatrooms/%s.pem", chatRoom.ID, chatRoom.Name, chatRoom.ID)
 
 		case "ls":
 			c.ui <- "Chatrooms - "
-			for _, cr := range c.chatroomsID {
-				c.ui <- fmt.Sprintf("\t%s (%s)", cr.Name, cr.ID)
+			for _, cr := range c.rooms() {
+				if cr.manager() {
+					c.ui <- fmt.Sprintf("\t%s (%s) - manager", cr.Name, cr.ID)
+				} else {
+					c.ui <- fmt.Sprintf("\t%s (%s)", cr.Name, cr.ID)
+				}
 				c.ui <- "\tParticipants - "
-				for k, v := range cr.participants {
+				for k, v := range cr.Participants() {
 					c.ui <- fmt.Sprintf("\t\t%s - %s", k, v.String())
 				}
 			}
 
 		case "self":
 			c.ui <- fmt.Sprintf("I am:\n\t%#v", c.Node.ID)
-			c.ui <- fmt.Sprintf("\tConnection: %s", c.connection.LocalAddr())
-			c.ui <- fmt.Sprintf("\tRequests Waiting: \n\t\t%# v", pretty.Formatter(c.Network.AwaitingResponse))
+			c.ui <- fmt.Sprintf("\tIdentity: %s (%s)", c.defaultNickname, fingerprint(c.identity))
+			c.ui <- fmt.Sprintf("\tConnection: %s", c.transport.LocalAddr())
+			c.ui <- fmt.Sprintf("\tRequests Waiting: \n\t\t%# v", pretty.Formatter(c.Network.AwaitingResponse()))
 
 		case "send":
 			c.ui <- "Room ID:"
@@ -131,25 +142,216 @@ func (c *client) inputloop() {
 			msg = strings.TrimSpace(msg)
 			c.Send(argID, msg)
 
+		case "log":
+			c.ui <- "Room ID:"
+			argID, _ := reader.ReadString('\n')
+			argID = strings.TrimSpace(argID)
+
+			chatRoom, ok := c.room(argID)
+			if !ok {
+				c.ui <- fmt.Sprintf("Chatroom %s not found\n", argID)
+				continue
+			}
+			for _, m := range chatRoom.Log() {
+				c.ui <- fmt.Sprintf("[%d] %s %s: %s", m.Lamport, m.ID, displayName(m), string(m.Message))
+			}
+
+		case "open":
+			c.ui <- "Room ID:"
+			argID, _ := reader.ReadString('\n')
+			argID = strings.TrimSpace(argID)
+
+			c.ui <- "Message ID (see log):"
+			argMsg, _ := reader.ReadString('\n')
+			argMsg = strings.TrimSpace(argMsg)
+
+			chatRoom, ok := c.room(argID)
+			if !ok {
+				c.ui <- fmt.Sprintf("Chatroom %s not found\n", argID)
+				continue
+			}
+			issuedTo, issued, err := chatRoom.openMessage(argMsg)
+			if err != nil {
+				c.ui <- fmt.Sprintf("...Unable to tell who sent %s: %s", argMsg, err)
+				continue
+			}
+			c.ui <- fmt.Sprintf("...%s was sent with the member key issued to %s on %s", argMsg, issuedTo, issued)
+
+		case "revoke":
+			c.ui <- "Room ID:"
+			argID, _ := reader.ReadString('\n')
+			argID = strings.TrimSpace(argID)
+
+			c.ui <- "Who to kick out - the ID of one of their messages (see log), or their fingerprint:"
+			argTarget, _ := reader.ReadString('\n')
+			argTarget = strings.TrimSpace(argTarget)
+			c.Revoke(argID, argTarget)
+
+		case "nick":
+			c.ui <- "Room ID (blank for every room without a nickname of its own):"
+			argID, _ := reader.ReadString('\n')
+			argID = strings.TrimSpace(argID)
+
+			c.ui <- "Nickname:"
+			argNick, _ := reader.ReadString('\n')
+			argNick = strings.TrimSpace(argNick)
+			if err := validNickname(argNick); err != nil {
+				c.ui <- fmt.Sprintf("...Invalid nickname: %s", err)
+				continue
+			}
+
+			if argID == "" {
+				c.defaultNickname = argNick
+				continue
+			}
+			chatRoom, ok := c.room(argID)
+			if !ok {
+				c.ui <- fmt.Sprintf("Chatroom %s not found\n", argID)
+				continue
+			}
+			chatRoom.lock.Lock()
+			chatRoom.nickname = argNick
+			chatRoom.lock.Unlock()
+
 		case "invite":
 			c.ui <- "Room ID:"
 			argID, _ := reader.ReadString('\n')
 			argID = strings.TrimSpace(argID)
 
-			chatRoom, ok := c.chatroomsID[argID]
+			chatRoom, ok := c.room(argID)
 			if !ok {
 				c.ui <- fmt.Sprintf("Chatroom %s not found\n", argID)
 				continue
 			}
+			c.ui <- "Who is it for:"
+			argFor, _ := reader.ReadString('\n')
+			argFor = strings.TrimSpace(argFor)
+
+			// members can't make invites themselves. They have to ask a manager
+			if !chatRoom.manager() {
+				if err := c.RequestInvite(chatRoom, argFor); err != nil {
+					c.ui <- fmt.Sprintf("...Unable to ask for an invite: %s", err)
+				}
+				continue
+			}
+
 			c.ui <- "...Generating Invite..."
-			chatRoom.GenerateInvite()
+			chatRoom.GenerateInvite(argFor)
 			c.ui <- "...Done Generating Invite."
+
+		case "approve", "deny":
+			c.ui <- "Request ID:"
+			argID, _ := reader.ReadString('\n')
+			argID = strings.TrimSpace(argID)
+
+			if err := c.AnswerInvite(argID, input == "approve"); err != nil {
+				c.ui <- fmt.Sprintf("...Unable to %s %s: %s", input, argID, err)
+				continue
+			}
+			c.ui <- "...Done. The answer is on its way"
+
+		case "quit":
+			c.shutdown()
 		}
 
 	}
 }
 
+// NewRoom creates a room that we're the manager of, and writes out its keys. It's not announced yet
+func (c *client) NewRoom(name string) *chatroom {
+	chatRoom := createChatroom()
+	chatRoom.Name = name
+	c.addRoom(chatRoom)
+
+	// add own address to participants
+	c.ui <- "...Updating Chatroom..."
+	chatRoom.addParticipant(string(c.Node.ID), c.transport.LocalAddr())
+	if err := chatRoom.addManager(string(c.Node.ID), c.identity); err != nil {
+		log.Printf("Unable to make ourselves the manager of %s. Error was: %s", chatRoom.ID, err)
+	}
+
+	chatRoom.ExportKeys()
+	if err := chatRoom.registerMember(chatRoom.memberPrivateKey.Tag(), "the room's creator"); err != nil {
+		log.Printf("Unable to write down the creator's member key. Error was: %s", err)
+	}
+	return chatRoom
+}
+
+// room is the room with the ID, if we're in it (or asking to be)
+func (c *client) room(id string) (*chatroom, bool) {
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
+	room, ok := c.chatroomsID[id]
+	return room, ok
+}
+
+// rooms returns all the rooms, in no particular order
+func (c *client) rooms() []*chatroom {
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
+	retVal := make([]*chatroom, 0, len(c.chatroomsID))
+	for _, room := range c.chatroomsID {
+		retVal = append(retVal, room)
+	}
+	return retVal
+}
+
+// addRoom adds a room, by its ID and name if it has one yet
+func (c *client) addRoom(room *chatroom) {
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
+	c.chatroomsID[room.ID] = room
+	if room.Name != "" {
+		c.chatroomsName[room.Name] = room
+	}
+}
+
+// nameRoom gives a room its name, once it's known
+func (c *client) nameRoom(room *chatroom, name string) {
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
+	room.Name = name
+	c.chatroomsName[name] = room
+}
+
+// registerHandlers registers the handlers of the room joining handshake with Network, and what answers what. See handshake.go
+func (c *client) registerHandlers() {
+	c.Network.Handle("REQUEST_ROOM", c.issueChallenge)
+	c.Network.Handle("CHALLENGE", c.challengeResponse)
+	c.Network.Handle("CHALLENGE_RESPONSE", c.verifyChallengeResponse)
+	c.Network.Handle("ADMITTED", c.admitted)
+
+	c.Network.Expect("REQUEST_ROOM", "CHALLENGE")
+	c.Network.Expect("CHALLENGE", "CHALLENGE_RESPONSE")
+	c.Network.Expect("CHALLENGE_RESPONSE", "ADMITTED", "FAILED_CHALLENGE")
+}
+
+// shutdown saves the node ID and routing table so the next run can pick up where this one left off
+func (c *client) shutdown() {
+	if err := c.Node.SaveState(c.stateFile); err != nil {
+		log.Printf("Unable to save state to %s. Error was: %s", c.stateFile, err)
+	}
+	os.Exit(0)
+}
+
+var (
+	seedsFlag    = flag.String("seeds", "", "comma separated host:port list of nodes to bootstrap off")
+	seedFileFlag = flag.String("seedfile", "seeds.txt", "file of host:port nodes to bootstrap off, one per line")
+	streamFlag   = flag.Bool("stream", true, "send room messages over TCP streams where possible, falling back to UDP")
+	nickFlag     = flag.String("nick", DEFAULT_NICKNAME, "what to go by in rooms. Can be changed per room with nick")
+)
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] kademliaPort chatPort\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	// check if all the directories exist. If not, create them
 	_, err := os.Stat("chatrooms/")
 	if os.IsNotExist(err) {
@@ -168,21 +370,60 @@ func main() {
 
 	log.Println(os.Args)
 	c := newClient()
-	c.Node.Port, _ = strconv.Atoi(os.Args[1])
-	c.port, _ = strconv.Atoi(os.Args[2])
+	c.Node.Port, _ = strconv.Atoi(flag.Arg(0))
+	c.port, _ = strconv.Atoi(flag.Arg(1))
+
+	// who we are - this is the same key every run, so the fingerprint others see doesn't change
+	if c.privateKey, err = bootstrapCrypto(); err != nil {
+		log.Fatalf("Unable to load or generate pem.pem: %s", err)
+	}
+	if c.identity, err = x509.MarshalPKIXPublicKey(&c.privateKey.PublicKey); err != nil {
+		log.Fatalf("Unable to marshal public key: %s", err)
+	}
+	if err = validNickname(*nickFlag); err != nil {
+		log.Fatalf("Invalid nickname: %s", err)
+	}
+	c.defaultNickname = *nickFlag
+
+	seeds, err := readSeeds(*seedFileFlag)
+	if err != nil {
+		log.Printf("Unable to read seeds from %s. Error was: %s", *seedFileFlag, err)
+	}
+	for _, seed := range strings.Split(*seedsFlag, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+
+	// the state file is per port, so that several nodes can be run from the same directory
+	c.stateFile = fmt.Sprintf("node_%d.state", c.Node.Port)
+	contacts, err := c.Node.LoadState(c.stateFile)
+	if err != nil {
+		log.Printf("Unable to load state from %s, starting afresh. Error was: %s", c.stateFile, err)
+	}
+
+	// whatever ID was saved, ours is the one made from our identity - no one else can use it. See nodeIDOf
+	c.Node.ID = nodeIDOf(c.identity)
 
 	c.initNetwork()
 
 	c.Network = kademlia.NewKademlia()
 	c.Network.Node = c.Node
+	c.Network.StateFile = c.stateFile
 
 	// register new handlers with Network
-	c.Network.ResponseHandler["REQUEST_ROOM"] = c.issueChallenge
-	c.Network.ResponseHandler["CHALLENGE"] = c.challengeResponse
-	c.Network.ResponseHandler["CHALLENGE_RESPONSE"] = c.verifyChallengeResponse
-	c.Network.ResponseHandler["GROUP_PRIVATE_KEY"] = c.receiveGroupPrivateKey
+	c.registerHandlers()
 
+	c.Network.Listen()
 	go c.Network.Run()
+	go c.joinNetwork(contacts, seeds)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		c.shutdown()
+	}()
 
 	go c.readFromSocket()
 
@@ -190,6 +431,8 @@ func main() {
 
 	go c.processMessages()
 
+	go c.skipGaps()
+
 	go c.uiloop()
 
 	c.inputloop()
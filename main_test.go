@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chewxy/nanjingtaxi/sim"
+)
+
+const SIM_CHAT_PORT = sim.SIM_PORT + 1
+
+// inTempDir runs the test in a directory of its own, as the keys, chatrooms and invites are all relative to it
+func inTempDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	for _, dir := range []string{"chatrooms", "keys", "invites"} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newSimClient puts a chat client on a new simulated node, with its room messages on a transport of their own. The node's
+// ID is made from the client's identity, the same as a real one's
+func newSimClient(t *testing.T, s *sim.Sim, nickname string) *client {
+	c := newClient()
+	c.port = SIM_CHAT_PORT
+	c.defaultNickname = nickname
+
+	var err error
+	if c.privateKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if c.identity, err = x509.MarshalPKIXPublicKey(&c.privateKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	node := s.AddNodeWithID(nodeIDOf(c.identity))
+	c.Node = node.Node
+	c.Network = node.Kademlia
+	if c.transport, err = s.Listen(node, c.port); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for range c.ui {
+		}
+	}()
+	c.registerHandlers()
+	go c.readFromSocket()
+	go c.processPackets()
+	go c.processMessages()
+	go c.skipGaps()
+	return c
+}
+
+// join has c join the room with an invite from its manager (whose room is the first of rooms), and waits until it and
+// everyone in rooms have heard of each other
+func join(t *testing.T, c *client, rooms []*chatroom) *chatroom {
+	rooms[0].GenerateInvite(c.defaultNickname)
+	for _, suffix := range []string{"_member.pem", "_room.pem", "_managers.pem"} {
+		if err := os.Rename("invites/"+rooms[0].ID+suffix, "keys/"+rooms[0].ID+suffix); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.RequestRoom(rooms[0].ID)
+	joined, ok := c.room(rooms[0].ID)
+	if !ok {
+		t.Fatalf("%s didn't get as far as asking for the room", c.defaultNickname)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		everyone := len(joined.Participants()) == len(rooms)+1
+		for _, room := range rooms {
+			_, ok := room.participant(string(c.Node.ID))
+			everyone = everyone && ok
+		}
+		if everyone {
+			return joined
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s wasn't admitted, or not everyone heard of them", c.defaultNickname)
+		}
+	}
+}
+
+// a few chat clients on a simulated network join a room and talk. Everyone should hear everything
+func TestChatOverSim(t *testing.T) {
+	inTempDir(t)
+	s := sim.New(16, 1)
+	defer s.Close()
+
+	var clients []*client
+	for i := 0; i < 4; i++ {
+		clients = append(clients, newSimClient(t, s, fmt.Sprintf("client%d", i)))
+	}
+
+	manager := clients[0]
+	rooms := []*chatroom{manager.NewRoom("sim")}
+	manager.announceRoom(rooms[0].ID)
+	for _, c := range clients[1:] {
+		rooms = append(rooms, join(t, c, rooms))
+	}
+
+	// a little loss, so some of it has to be resent
+	s.Network.SetLoss(0.05)
+
+	const PER_CLIENT = 3
+	for i := 0; i < PER_CLIENT; i++ {
+		for j, c := range clients {
+			c.Send(rooms[j].ID, fmt.Sprintf("%s %d", c.defaultNickname, i))
+		}
+	}
+
+	var r sim.DeliveryResult
+	r.Sent = len(clients) * (len(clients) - 1) * PER_CLIENT
+	for deadline := time.Now().Add(45 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		r.Delivered = 0
+		for j, room := range rooms {
+			for _, msg := range room.Log() {
+				if msg.Sender != string(clients[j].Node.ID) {
+					r.Delivered++
+				}
+			}
+		}
+		if r.Delivered >= r.Sent {
+			break
+		}
+	}
+	sim.AssertDelivery(t, r, 1)
+}
+
+// rooms are looked up by the handlers and processMessages while the input loop adds them. Run with -race
+func TestRoomsConcurrently(t *testing.T) {
+	c := newClient()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			room := createChatroom()
+			c.addRoom(room)
+			c.nameRoom(room, room.ID)
+		}()
+		go func() {
+			defer wg.Done()
+			for _, room := range c.rooms() {
+				if _, ok := c.room(room.ID); !ok {
+					t.Errorf("%s is in rooms, but not to be found", room.ID)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(c.rooms()) != 10 {
+		t.Errorf("expected 10 rooms. Got %d", len(c.rooms()))
+	}
+}
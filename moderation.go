@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// moderation: a group signature doesn't say which member key made it, but whoever holds the room's private key can open a
+// signature to get the tag of the member key that made it. Every member key that's issued (the creator's own, and the ones
+// in the invites) is written down in chatrooms/<roomID>_members.txt, so a tag can be traced back to whoever the invite was for.
+// Each line is: tag (hex) | when it was issued | who it was for
+var (
+	errNoSignature   = errors.New("message has no group signature")
+	errCannotOpen    = errors.New("unable to open the signature. Only the room's private key can")
+	errUnknownMember = errors.New("the member key isn't one issued from here")
+)
+
+func membersFile(roomID string) string { return fmt.Sprintf("chatrooms/%s_members.txt", roomID) }
+
+// registerMember writes down who a member key was issued to
+func (room *chatroom) registerMember(tag []byte, issuedTo string) error {
+	f, err := os.OpenFile(membersFile(room.ID), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	issuedTo = strings.Replace(issuedTo, "\n", " ", -1)
+	_, err = fmt.Fprintf(f, "%x | %s | %s\n", tag, time.Now().Format(time.RFC3339), issuedTo)
+	return err
+}
+
+// member looks up who the member key with the tag was issued to, and when
+func (room *chatroom) member(tag []byte) (issuedTo, issued string, err error) {
+	f, err := os.Open(membersFile(room.ID))
+	if os.IsNotExist(err) {
+		return "", "", errUnknownMember
+	}
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	want := hex.EncodeToString(tag)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " | ", 3)
+		if len(fields) == 3 && fields[0] == want {
+			return fields[2], fields[1], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	return "", "", errUnknownMember
+}
+
+// openMessage finds out which member signed the message with the ID
+func (room *chatroom) openMessage(messageID string) (issuedTo, issued string, err error) {
+	var msg *Message
+	for _, m := range room.Log() {
+		if m.ID == messageID {
+			msg = &m
+			break
+		}
+	}
+	switch {
+	case msg == nil:
+		return "", "", fmt.Errorf("no message %s in the log", messageID)
+	case len(msg.Signature) == 0:
+		return "", "", errNoSignature
+	}
+
+	if !room.manager() {
+		return "", "", errNotManager
+	}
+	tag, ok := room.groupPrivateKey.Open(msg.Signature)
+	if !ok {
+		return "", "", errCannotOpen
+	}
+	return room.member(tag)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+// a message in the log is traced back to the invite whose member key signed it - by managers only
+func TestOpenMessage(t *testing.T) {
+	inTempDir(t)
+	room := createChatroom()
+	if err := room.registerMember(room.memberPrivateKey.Tag(), "the room's creator"); err != nil {
+		t.Fatal(err)
+	}
+
+	// signed is a message with the ID, signed by a member key of the room. It's put in the log
+	signed := func(id string, issuedTo string) Message {
+		key, err := room.groupPrivateKey.NewMember(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if issuedTo != "" {
+			if err := room.registerMember(key.Tag(), issuedTo); err != nil {
+				t.Fatal(err)
+			}
+		}
+		member := newChatroom(room.ID, nil, room.groupPublicKey, key)
+		msg, err := member.sign(Message{Type: TextMessage, Destination: room.ID, ID: id, Message: []byte("hi")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		room.lock.Lock()
+		room.record(msg)
+		room.lock.Unlock()
+		return msg
+	}
+	signed("1", "bob")
+	signed("2", "carol | who's bob's friend")
+	signed("3", "")
+	room.lock.Lock()
+	room.record(Message{Type: TextMessage, Destination: room.ID, ID: "4"})
+	room.lock.Unlock()
+
+	for id, want := range map[string]string{"1": "bob", "2": "carol | who's bob's friend"} {
+		issuedTo, issued, err := room.openMessage(id)
+		if err != nil {
+			t.Fatalf("message %s: %s", id, err)
+		}
+		if issuedTo != want || issued == "" {
+			t.Errorf("message %s: expected it to be from the invite for %q. Got %q, issued %q", id, want, issuedTo, issued)
+		}
+	}
+	if _, _, err := room.openMessage("3"); err != errUnknownMember {
+		t.Errorf("a member key that was never written down: expected %q. Got %v", errUnknownMember, err)
+	}
+	if _, _, err := room.openMessage("4"); err != errNoSignature {
+		t.Errorf("an unsigned message: expected %q. Got %v", errNoSignature, err)
+	}
+	if _, _, err := room.openMessage("5"); err == nil {
+		t.Error("a message that isn't in the log was opened")
+	}
+
+	// a member with the same log can't
+	member := newChatroom(room.ID, nil, room.groupPublicKey, room.memberPrivateKey)
+	member.log = room.Log()
+	if _, _, err := member.openMessage("1"); err != errNotManager {
+		t.Errorf("expected %q. Got %v", errNotManager, err)
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/chewxy/nanjingtaxi/kademlia"
 	"github.com/vmihailenco/msgpack"
 )
 
@@ -15,6 +20,16 @@ const (
 	ControlMessage MessageType = iota
 	VoiceMessage
 	TextMessage
+	AckMessage
+	RekeyMessage
+	InviteRequestMessage
+	InviteReplyMessage
+	SenderKeyMessage
+)
+
+const (
+	BOOTSTRAP_TIMEOUT = time.Minute      // how long joining the network may take, from the first pings to the last bucket refresh
+	REQUEST_TIMEOUT   = 30 * time.Second // how long a room request may take, from the lookup to the challenge
 )
 
 type packet struct {
@@ -26,77 +41,128 @@ type Message struct {
 	Type        MessageType
 	Destination string // roomID
 	Message     []byte
+
+	ID       string // acks refer to this
+	Sender   string // node ID of the sender
+	Sequence uint64 // per sender, per room. Receivers use this to put things back in order, and to spot duplicates
+	Lamport  uint64 // Lamport timestamp. This orders the room log
+
+	Chain      string // which of the sender's chains the message key is off, and how far along. See senderkeys.go
+	Generation uint32
+
+	// who it's from. These never go out in the clear - they're sealed in with the body. See sealUnder
+	Nickname          string `msgpack:"-"` // what the sender goes by in the room
+	Identity          []byte `msgpack:"-"` // the sender's RSA public key, DER encoded. See identity.go
+	IdentitySignature []byte `msgpack:"-"`
+
+	Signature []byte // group signature by the sender's member key. See signature.go
 }
 
-func (c *client) connectToNetwork(address string) {
-	addr, _ := net.ResolveUDPAddr("udp", address)
-	log.Printf("ADDRESS IS: %#v\n", addr)
-	token := c.Network.PingIP(addr)
+// envelope is a message, along with where it came from
+type envelope struct {
+	Message
+	from *net.UDPAddr
+}
 
+func (c *client) connectToNetwork(address string) {
 	c.ui <- "...Connecting..."
-	// check if successful - after 2 seconds?
-	time.Sleep(500 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), BOOTSTRAP_TIMEOUT)
+	defer cancel()
+
+	responded, contacts := c.Network.Bootstrap(ctx, []string{address})
+	if responded == 0 {
+		c.ui <- fmt.Sprintf("...Connection to %s Failed", address)
+		return
+	}
+	c.ui <- fmt.Sprintf("...Connection OK. %d contacts acquired", contacts)
+}
 
-	_, ok := c.Network.AwaitingResponse[token]
+// joinNetwork is the unattended way of connecting: the contacts saved from the last run are pinged, and then the seeds are
+// bootstrapped off, so there's no need to cx after a start
+func (c *client) joinNetwork(saved []*kademlia.RemoteNode, seeds []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), BOOTSTRAP_TIMEOUT)
+	defer cancel()
 
-	if ok {
-		c.ui <- "...Connection Failed"
-		return // connection failed. TODO: REPORT BACK
+	if len(saved) > 0 {
+		n := c.Network.Rejoin(ctx, saved)
+		c.ui <- fmt.Sprintf("...%d of %d saved contacts responded", n, len(saved))
 	}
 
-	c.ui <- fmt.Sprintf("...Connection OK, sending FindNodes now. Addr is: %s", addr)
-	remote, ok := c.Node.AddressToNode[addr.String()]
+	if len(seeds) > 0 {
+		responded, contacts := c.Network.Bootstrap(ctx, seeds)
+		c.ui <- fmt.Sprintf("...%d of %d seeds responded. %d contacts acquired", responded, len(seeds), contacts)
+	}
 
-	go c.Network.FindNode(remote, c.Node.ID)
-	return
+	if len(saved) > 0 || len(seeds) > 0 {
+		if len(c.Node.Contacts()) == 0 {
+			c.ui <- "...Unable to join the network. Use cx to connect"
+		}
+	}
 }
 
-func (c *client) initNetwork() {
-	address := fmt.Sprintf(":%d", c.port)
-	listener, err := net.ListenPacket("udp4", address)
+// readSeeds reads a seeds file: one host:port per line. Blank lines and anything after a # are ignored.
+// A missing file just means no seeds
+func readSeeds(filename string) ([]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	var seeds []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			seeds = append(seeds, line)
+		}
+	}
+	return seeds, nil
+}
+
+func (c *client) initNetwork() {
+	transport, err := kademlia.NewUDPTransport(c.port)
 	if err != nil {
 		// do something
 		c.ui <- "...Unable to start UDP listener. Panicking now."
 		panic(err) // temp. TODO: replace with actual error handling.
 	}
 
-	var socket *net.UDPConn
-	if listener != nil {
-		socket = listener.(*net.UDPConn)
+	// messages are framed, so big ones (a room with lots of participants, long chat messages) get fragmented instead of truncated
+	c.transport = kademlia.NewFramedTransport(transport)
+	if !*streamFlag {
+		return
 	}
 
-	c.connection = socket
+	// room traffic goes over streams where it can, so it's not lost on bad networks. UDP is still there for when it can't
+	stream, err := kademlia.NewStreamTransport(c.port, c.transport)
+	if err != nil {
+		log.Printf("Unable to listen for streams on port %d, sticking to UDP. Error was: %s", c.port, err)
+		return
+	}
+	c.transport = stream
 }
 
 func (c *client) readFromSocket() {
 	for {
-		var b []byte = make([]byte, 1024)
-		n, addr, err := c.connection.ReadFromUDP(b)
-
-		b = b[0:n]
-		log.Printf("READ %d: %#v\n", len(b), b)
-
+		b, addr, err := c.transport.Receive()
 		if err != nil {
-			panic("HELP!!") // do actual proper error handling kthxbai
+			log.Printf("Unable to read from the transport, giving up. Error was: %s", err)
+			return
 		}
 
-		if n > 0 {
+		if len(b) > 0 {
 			pack := packet{b, addr}
 			select {
 			case c.packets <- pack:
 				continue
 			case <-c.kill:
-				break
+				return
 			}
 		}
-
-		select {
-		case <-c.kill:
-			break
-		default:
-			continue
-		}
 	}
 }
 
@@ -110,63 +176,198 @@ func (c *client) processPackets() {
 			continue
 		}
 
-		c.messages <- msg
+		c.messages <- envelope{msg, pack.returnAddress}
 	}
 }
 
 func (c *client) processMessages() {
-	for msg := range c.messages {
-		if msg.Type == TextMessage {
-			room, ok := c.chatroomsID[msg.Destination]
+	for env := range c.messages {
+		msg := env.Message
+		switch msg.Type {
+		case TextMessage:
+			room, ok := c.room(msg.Destination)
 			if !ok {
 				c.ui <- "...Unable to find chatroom"
 				continue
 			}
-			friendlyName := room.Name
-			log.Printf("Received TXT : %s\n", msg.Message)
-			c.ui <- fmt.Sprintf("%s\n%s\n", friendlyName, string(msg.Message))
+
+			// anything that isn't signed by a member is dropped, unacked, before it's opened
+			if err := room.verify(msg); err != nil {
+				log.Printf("DROPPED message %s to room %s from %s: %s", msg.ID, msg.Destination, env.from, err)
+				c.ui <- fmt.Sprintf("...Dropped a message to %s that failed to authenticate", room.Name)
+				continue
+			}
+
+			// a duplicate still gets acked - the sender is probably resending because our ack got lost. Its key is gone, so it
+			// can't be opened again, but there's no need to
+			if room.seen(msg) {
+				c.ack(room, msg, env.from)
+				continue
+			}
+
+			// it's only opened (and its key used up) if it's signed by its sender's identity
+			msg, err := room.openText(msg)
+			if err == nil {
+				err = room.bindIdentity(msg.Sender, msg.Identity)
+			}
+			if err == errNoSenderKey {
+				// their sender key hasn't got here yet. It's not acked, so it'll be resent
+				log.Printf("HELD OFF on message %s to room %s from %s: %s", msg.ID, msg.Destination, env.from, err)
+				continue
+			}
+			if err != nil {
+				log.Printf("DROPPED message %s to room %s from %s: %s", msg.ID, msg.Destination, env.from, err)
+				c.ui <- fmt.Sprintf("...Dropped a message to %s that failed to authenticate", room.Name)
+				continue
+			}
+			c.ack(room, msg, env.from)
+
+			delivered, lost := room.receive(msg)
+			c.show(room, delivered, lost)
+
+		case RekeyMessage:
+			room, ok := c.room(msg.Destination)
+			if !ok {
+				continue
+			}
+			if room.handledAlready(msg.ID) {
+				c.ack(room, msg, env.from) // a resend. Our ack got lost. It won't authenticate any more, as the keys have changed
+				continue
+			}
+
+			msg, err := room.authenticate(msg)
+			if err != nil {
+				log.Printf("DROPPED rekey %s to room %s from %s: %s", msg.ID, msg.Destination, env.from, err)
+				continue
+			}
+			c.ack(room, msg, env.from)
+
+			if err := c.rekeyed(room, msg); err != nil {
+				c.ui <- fmt.Sprintf("...Room %s was rekeyed, but the new keys couldn't be had: %s", room.Name, err)
+			}
+
+		case InviteRequestMessage, InviteReplyMessage:
+			room, ok := c.room(msg.Destination)
+			if !ok {
+				continue
+			}
+
+			msg, err := room.authenticate(msg)
+			if err != nil {
+				log.Printf("DROPPED invite message %s to room %s from %s: %s", msg.ID, msg.Destination, env.from, err)
+				continue
+			}
+			c.ack(room, msg, env.from)
+			if !room.handle(msg.ID) {
+				continue // a resend
+			}
+
+			if msg.Type == InviteRequestMessage {
+				c.inviteRequested(room, msg)
+			} else if err := c.inviteReplied(room, msg); err != nil {
+				c.ui <- fmt.Sprintf("...Unable to use the invite from %s: %s", displayName(msg), err)
+			}
+
+		case SenderKeyMessage:
+			room, ok := c.room(msg.Destination)
+			if !ok {
+				continue
+			}
+
+			msg, err := room.authenticate(msg)
+			if err != nil {
+				log.Printf("DROPPED sender key %s to room %s from %s: %s", msg.ID, msg.Destination, env.from, err)
+				continue
+			}
+			c.ack(room, msg, env.from)
+			if !room.handle(msg.ID) {
+				continue // a resend
+			}
+
+			if err := c.senderKeyed(room, msg, env.from); err != nil {
+				c.ui <- fmt.Sprintf("...Unable to use the sender key from %s: %s", displayName(msg), err)
+			}
+
+		case AckMessage:
+			room, ok := c.room(msg.Destination)
+			if !ok {
+				continue
+			}
+
+			msg, err := room.authenticate(msg)
+			if err != nil {
+				log.Printf("DROPPED ack %s to room %s from %s: %s", msg.ID, msg.Destination, env.from, err)
+				continue
+			}
+			c.acked(msg)
 		}
 	}
 }
 
-func sendMsg(conn *net.UDPConn, returnAddress *net.UDPAddr, msg Message) {
+// show puts the messages that have been delivered up on the UI, after saying how many went missing before them
+func (c *client) show(room *chatroom, delivered []Message, lost uint64) {
+	if lost > 0 {
+		c.ui <- fmt.Sprintf("...%d messages to %s went missing", lost, room.Name)
+	}
+	for _, m := range delivered {
+		log.Printf("Received TXT : %s\n", m.Message)
+		if clash := room.identify(m); clash != "" {
+			c.ui <- fmt.Sprintf("...%s is also what %s goes by in %s. Tell them apart by the fingerprint", m.Nickname, clash, room.Name)
+		}
+		c.ui <- fmt.Sprintf("%s [%d] %s\n%s\n", room.Name, m.Lamport, displayName(m), string(m.Message))
+	}
+}
+
+// authenticate checks that the message is signed by a member of the room, decrypts it with the room key, and checks
+// that it's signed by the identity sealed in with it, and that the identity is the sender's. A copy of the message with
+// the body decrypted is returned
+func (room *chatroom) authenticate(msg Message) (Message, error) {
+	if err := room.verify(msg); err != nil {
+		return msg, err
+	}
+	opened, err := room.open(msg)
+	if err != nil {
+		return msg, err
+	}
+	if err := verifyIdentity(opened); err != nil {
+		return msg, err
+	}
+	return opened, room.bindIdentity(opened.Sender, opened.Identity)
+}
+
+func sendMsg(t kademlia.Transport, address *net.UDPAddr, msg Message) {
 	b, err := msgpack.Marshal(msg)
 	if err != nil {
 		// do something!
 	}
-	log.Printf("Conn: %#v\nReturnAddr: %#v\n", conn, returnAddress)
-	bytesWritten, networkErr := conn.Write(b)
 
-	if networkErr != nil {
-		log.Fatalf("FAILED TO WRITE %d BYTES. Reason: %v", bytesWritten, networkErr)
-		return
+	if networkErr := t.Send(b, address); networkErr != nil {
+		log.Printf("FAILED TO WRITE %d BYTES TO %s. Reason: %v", len(b), address, networkErr)
 	}
 }
 
 func (c *client) Send(id string, message string) {
-	room, ok := c.chatroomsID[id]
+	room, ok := c.room(id)
 	if !ok {
 		c.ui <- fmt.Sprintf("...No such chatroom: %s", id)
+		return
 	}
 
-	msg := Message{
-		Type:        TextMessage,
-		Destination: room.ID,
-		Message:     []byte(message),
-	}
+	// everyone needs our sender key before they can read anything. See senderkeys.go
+	c.shareSenderKeys(room)
 
-	rA := c.connection.LocalAddr()
+	room.sending.Lock()
+	msg, err := c.secure(room, room.newText(string(c.Node.ID), c.nickname(room), c.identity, message))
+	room.sending.Unlock()
+	if err != nil {
+		c.ui <- fmt.Sprintf("...Unable to encrypt and sign message: %s", err)
+		return
+	}
 
-	for _, v := range room.participants {
-		conn, err := net.DialUDP("udp", nil, v)
-		if err != nil {
-			c.ui <- fmt.Sprintf("...Unable to create connection to %s", v)
-		}
-		returnAddr, ok := rA.(*net.UDPAddr)
-		if !ok {
-			log.Printf("Return Addr is %T\n", rA)
-			c.ui <- "...Return Address is not a UDP Address"
+	for participant, v := range room.Participants() {
+		if participant == string(c.Node.ID) {
+			continue
 		}
-		go sendMsg(conn, returnAddr, msg)
+		go c.sendReliably(participant, v, msg)
 	}
 }
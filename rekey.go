@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/agl/pond/bbssig"
+	"github.com/vmihailenco/msgpack"
+)
+
+// rekeying: kicking someone out of a room means nothing they hold can be used any more. They have the room key and their
+// member key - and if they're a manager, the group private key, so they could mint new invites for themselves.
+// So instead of revoking their member key, the room gets a whole new group, and everyone else is enrolled into it again:
+// each remaining participant is sent a new member key and a new room key (and the managers the new group private key),
+// encrypted to their RSA identity. The rekey itself goes out like any other message - sealed and signed with the old
+// keys - to everyone but the ones being kicked out. Only managers can rekey.
+//
+// Only participants whose identity is known (they've said something, or joined through us) can be sent new keys.
+// The rest are dropped from the room along with whoever's being kicked out, and will need new invites
+const REKEY_LABEL = "nanjingtaxi rekey"
+
+var errNotRekeyed = errors.New("we weren't sent new keys. Ask for a new invite")
+
+type rekey struct {
+	GroupPublicKey []byte
+	Grants         map[string][]byte // node ID -> sealed grant, for every participant who's staying
+}
+
+// grant is what each participant who's staying gets
+type grant struct {
+	GroupPrivateKey []byte // empty, unless the participant is a manager
+	MemberKey       []byte
+	RoomKey         []byte
+}
+
+// sealTo encrypts to an RSA public key: a fresh AES key is wrapped with RSA-OAEP, and the plaintext is sealed with it
+func sealTo(pub *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	key := newRoomKey()
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, []byte(REKEY_LABEL))
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// the key's never used again, so the nonce can be all zeroes
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(wrapped, nonce, plaintext, nil), nil
+}
+
+// openWith decrypts what sealTo sealed
+func openWith(priv *rsa.PrivateKey, sealed []byte) ([]byte, error) {
+	size := priv.PublicKey.N.BitLen() / 8
+	if len(sealed) < size {
+		return nil, errTampered
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, sealed[:size], []byte(REKEY_LABEL))
+	if err != nil {
+		return nil, errTampered
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed[size:], nil)
+	if err != nil {
+		return nil, errTampered
+	}
+	return plaintext, nil
+}
+
+// identities returns the public keys of the participants we know of, ours included
+func (c *client) identities(room *chatroom) map[string][]byte {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	retVal := map[string][]byte{string(c.Node.ID): c.identity}
+	for participant, pub := range room.publicKeys {
+		if identity, err := x509.MarshalPKIXPublicKey(pub); err == nil {
+			retVal[participant] = identity
+		}
+	}
+	return retVal
+}
+
+// kickable works out which participants are meant by target: either the sender of the message with that ID, or whoever
+// has the key with that fingerprint
+func (c *client) kickable(room *chatroom, target string) []string {
+	for _, m := range room.Log() {
+		if m.ID == target && m.Sender != string(c.Node.ID) {
+			return []string{m.Sender}
+		}
+	}
+
+	var retVal []string
+	for participant, identity := range c.identities(room) {
+		if participant != string(c.Node.ID) && fingerprint(identity) == target {
+			retVal = append(retVal, participant)
+		}
+	}
+	return retVal
+}
+
+// Revoke kicks the participants meant by target (see kickable) out of the room, and rekeys the room for everyone else
+func (c *client) Revoke(id string, target string) {
+	room, ok := c.room(id)
+	if !ok {
+		c.ui <- fmt.Sprintf("...No such chatroom: %s", id)
+		return
+	}
+	if !room.manager() {
+		c.ui <- fmt.Sprintf("...Only managers can kick people out of %s", room.Name)
+		return
+	}
+
+	kicked := c.kickable(room, target)
+	if len(kicked) == 0 {
+		c.ui <- fmt.Sprintf("...%s is neither a message ID from someone else nor the fingerprint of a participant", target)
+		return
+	}
+	out := make(map[string]bool)
+	for _, participant := range kicked {
+		out[participant] = true
+	}
+
+	groupPriv, err := bbssig.GenerateGroup(rand.Reader)
+	if err != nil {
+		c.ui <- fmt.Sprintf("...Unable to generate a new group: %s", err)
+		return
+	}
+	member, err := groupPriv.NewMember(rand.Reader)
+	if err != nil {
+		c.ui <- fmt.Sprintf("...Unable to generate a new member key: %s", err)
+		return
+	}
+	roomKey := newRoomKey()
+
+	rk := rekey{GroupPublicKey: groupPriv.Group.Marshal(), Grants: make(map[string][]byte)}
+	staying := make(map[string]*net.UDPAddr)
+	var unknown int
+	for participant, address := range room.Participants() {
+		if participant == string(c.Node.ID) || out[participant] {
+			continue
+		}
+
+		room.lock.Lock()
+		pub, ok := room.publicKeys[participant]
+		room.lock.Unlock()
+		if !ok {
+			unknown++
+			continue
+		}
+		identity, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			unknown++
+			continue
+		}
+
+		newMember, err := groupPriv.NewMember(rand.Reader)
+		if err != nil {
+			c.ui <- fmt.Sprintf("...Unable to generate a new member key: %s", err)
+			return
+		}
+		g := grant{MemberKey: newMember.Marshal(), RoomKey: roomKey}
+		if room.isManager(participant) {
+			g.GroupPrivateKey = groupPriv.Marshal()
+		}
+		b, err := msgpack.Marshal(g)
+		if err != nil {
+			c.ui <- fmt.Sprintf("...Unable to marshal the new keys: %s", err)
+			return
+		}
+		if rk.Grants[participant], err = sealTo(pub, b); err != nil {
+			c.ui <- fmt.Sprintf("...Unable to encrypt the new keys: %s", err)
+			return
+		}
+		staying[participant] = address
+
+		if err := room.registerMember(newMember.Tag(), fmt.Sprintf("%x (%s), on rekeying", participant, fingerprint(identity))); err != nil {
+			log.Printf("Unable to write down the new member key of %x. Error was: %s", participant, err)
+		}
+	}
+	if err := room.registerMember(member.Tag(), "ourselves, on rekeying"); err != nil {
+		log.Printf("Unable to write down our new member key. Error was: %s", err)
+	}
+
+	// the rekey goes out under the old keys - they're the only ones the others can check it with
+	msg, err := c.newControl(room, RekeyMessage, rk)
+	if err == nil {
+		msg, err = c.secure(room, msg)
+	}
+	if err != nil {
+		c.ui <- fmt.Sprintf("...Unable to seal the rekey: %s", err)
+		return
+	}
+	for participant, address := range staying {
+		go c.sendReliably(participant, address, msg)
+	}
+
+	staying[string(c.Node.ID)], _ = room.participant(string(c.Node.ID))
+	room.applyKeys(msg.ID, groupPriv, groupPriv.Group, member, roomKey, staying)
+	room.ExportKeys()
+	c.rotateSenderKey(room)
+
+	c.ui <- fmt.Sprintf("...%d kicked out of %s. The room has been rekeyed for the %d others", len(kicked), room.Name, len(staying)-1)
+	if unknown > 0 {
+		c.ui <- fmt.Sprintf("...%d participants have never said anything, so they couldn't be sent the new keys. They'll need new invites", unknown)
+	}
+}
+
+// rekeyed applies a rekey that someone else sent
+func (c *client) rekeyed(room *chatroom, msg Message) error {
+	if !room.fromManager(msg) {
+		return errNotManager
+	}
+
+	var rk rekey
+	if err := msgpack.Unmarshal(msg.Message, &rk); err != nil {
+		return err
+	}
+
+	sealed, ok := rk.Grants[string(c.Node.ID)]
+	if !ok {
+		return errNotRekeyed
+	}
+	b, err := openWith(c.privateKey, sealed)
+	if err != nil {
+		return err
+	}
+	var g grant
+	if err := msgpack.Unmarshal(b, &g); err != nil {
+		return err
+	}
+	if len(g.RoomKey) != ROOM_KEY_SIZE {
+		return fmt.Errorf("room key is %d bytes. Expected %d", len(g.RoomKey), ROOM_KEY_SIZE)
+	}
+
+	group, ok := room.groupPublicKey.Unmarshal(rk.GroupPublicKey)
+	if !ok {
+		return errors.New("unable to unmarshal the group public key")
+	}
+	var groupPriv *bbssig.PrivateKey
+	if len(g.GroupPrivateKey) > 0 {
+		if groupPriv, ok = new(bbssig.PrivateKey).Unmarshal(group, g.GroupPrivateKey); !ok {
+			return errors.New("unable to unmarshal the group private key")
+		}
+	}
+	member, ok := room.memberPrivateKey.Unmarshal(group, g.MemberKey)
+	if !ok {
+		return errors.New("unable to unmarshal the member key")
+	}
+
+	// everyone who was sent new keys stays, as does the sender. Everyone else is out
+	participants := room.Participants()
+	staying := make(map[string]*net.UDPAddr)
+	for participant, address := range participants {
+		if _, ok := rk.Grants[participant]; ok || participant == msg.Sender {
+			staying[participant] = address
+		}
+	}
+	kicked := len(participants) - len(staying)
+
+	room.applyKeys(msg.ID, groupPriv, group, member, g.RoomKey, staying)
+	room.ExportKeys()
+	c.rotateSenderKey(room)
+
+	c.ui <- fmt.Sprintf("...%s rekeyed %s. %d participants are no longer in it", displayName(msg), room.Name, kicked)
+	return nil
+}
+
+// applyKeys switches the room over to new keys, and to the participants who are staying
+func (room *chatroom) applyKeys(rekeyID string, groupPriv *bbssig.PrivateKey, group *bbssig.Group, member *bbssig.MemberKey, roomKey []byte, staying map[string]*net.UDPAddr) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	room.groupPrivateKey = groupPriv
+	room.groupPublicKey = group
+	room.memberPrivateKey = member
+	room.roomKey = roomKey
+	room.participants = staying
+	for participant := range room.publicKeys {
+		if _, ok := staying[participant]; !ok {
+			delete(room.publicKeys, participant)
+		}
+	}
+	for manager := range room.managers {
+		if _, ok := staying[manager]; !ok {
+			delete(room.managers, manager)
+		}
+	}
+	for sender, chains := range room.inbound {
+		if _, ok := staying[sender]; !ok {
+			for _, ch := range chains {
+				ch.wipe()
+			}
+			delete(room.inbound, sender)
+		}
+	}
+	for participant := range room.replyKeys {
+		if _, ok := staying[participant]; !ok {
+			delete(room.replyKeys, participant)
+		}
+	}
+	for participant := range room.replyTo {
+		if _, ok := staying[participant]; !ok {
+			delete(room.replyTo, participant)
+		}
+	}
+	for participant, sk := range room.unsent {
+		if _, ok := staying[participant]; !ok {
+			wipe(sk.ChainKey)
+			delete(room.unsent, participant)
+		}
+	}
+	room.handled[rekeyID] = true
+}
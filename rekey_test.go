@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/chewxy/nanjingtaxi/sim"
+)
+
+// said has c say something in the room, and waits until everyone in rooms has it in their log
+func said(t *testing.T, c *client, room *chatroom, text string, rooms ...*chatroom) {
+	c.Send(room.ID, text)
+	for deadline := time.Now().Add(10 * time.Second); !heard(text, rooms...); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%q from %s never got to everyone", text, c.defaultNickname)
+		}
+	}
+}
+
+// heard says whether the text is in the logs of all the rooms
+func heard(text string, rooms ...*chatroom) bool {
+	for _, room := range rooms {
+		var ok bool
+		for _, msg := range room.Log() {
+			ok = ok || string(msg.Message) == text
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func roomKeyOf(room *chatroom) []byte {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	return room.roomKey
+}
+
+// whoever's kicked out can neither read what's said after, nor say anything that's taken
+func TestRevoke(t *testing.T) {
+	inTempDir(t)
+	s := sim.New(8, 1)
+	defer s.Close()
+
+	manager, alice, mallory := newSimClient(t, s, "manager"), newSimClient(t, s, "alice"), newSimClient(t, s, "mallory")
+	rooms := []*chatroom{manager.NewRoom("sim")}
+	manager.announceRoom(rooms[0].ID)
+	rooms = append(rooms, join(t, alice, rooms))
+	rooms = append(rooms, join(t, mallory, rooms))
+	managers, alices, mallorys := rooms[0], rooms[1], rooms[2]
+
+	said(t, alice, alices, "hi from alice", managers, mallorys)
+	said(t, mallory, mallorys, "hi from mallory", managers, alices)
+
+	oldKey := roomKeyOf(managers)
+	manager.Revoke(managers.ID, fingerprint(mallory.identity))
+	for deadline := time.Now().Add(10 * time.Second); bytes.Equal(roomKeyOf(alices), oldKey); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("alice never got the new keys")
+		}
+	}
+	if !bytes.Equal(roomKeyOf(alices), roomKeyOf(managers)) {
+		t.Fatal("alice and the manager have different room keys")
+	}
+	if !bytes.Equal(roomKeyOf(mallorys), oldKey) {
+		t.Fatal("mallory got the new room key")
+	}
+	for _, room := range []*chatroom{managers, alices} {
+		if _, ok := room.participant(string(mallory.Node.ID)); ok {
+			t.Error("mallory is still a participant")
+		}
+	}
+
+	// what's sealed and signed now doesn't open or check out with what mallory has
+	msg, err := alice.newControl(alices, AckMessage, ackBody{"x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = alice.secure(alices, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := mallorys.verify(msg); err != errBadSignature {
+		t.Errorf("mallory checked a signature under the new group. Got %v", err)
+	}
+	if _, err := mallorys.open(msg); err != errTampered {
+		t.Errorf("mallory opened a message under the new room key. Got %v", err)
+	}
+
+	// and from the outside: alice is heard and mallory isn't, either way
+	said(t, alice, alices, "after mallory", managers)
+	mallory.Send(mallorys.ID, "still mallory")
+	said(t, manager, managers, "after mallory too", alices)
+	time.Sleep(time.Second)
+	for _, text := range []string{"after mallory", "after mallory too"} {
+		if heard(text, mallorys) {
+			t.Errorf("mallory read %q", text)
+		}
+	}
+	for i, room := range []*chatroom{managers, alices} {
+		if heard("still mallory", room) {
+			t.Errorf("%s took mallory's message", []string{"the manager", "alice"}[i])
+		}
+	}
+}
@@ -6,17 +6,21 @@ import (
 	"github.com/google/uuid"
 	"github.com/vmihailenco/msgpack"
 
+	"bytes"
+	"context"
+	"crypto/ecdh"
 	"fmt"
 	"io/ioutil"
 	"log"
+	mrand "math/rand"
 	"net"
 	"os"
-	"time"
+	"sync"
 
 	// "crypto/rsa"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha1"
+	"crypto/sha256"
 	// "crypto/x509"
 	"encoding/pem"
 )
@@ -27,15 +31,40 @@ type chatroom struct {
 
 	participants map[string]*net.UDPAddr
 	publicKeys   map[string]*rsa.PublicKey
+	nicknames    map[string]string         // fingerprint -> what they go by in the room. See identity.go
+	nickname     string                    // what we go by in the room. Empty means the default
+	handled      map[string]bool           // IDs of the rekeys and invite requests and replies that have been dealt with
+	managers     map[string]*rsa.PublicKey // node ID -> identity, of the participants that hold the group private key. See invites.go
 
-	groupPrivateKey *bbssig.PrivateKey
+	groupPrivateKey *bbssig.PrivateKey // only managers have this. It's nil for everyone else
 	groupPublicKey  *bbssig.Group
 
 	memberPrivateKey *bbssig.MemberKey
 
+	roomKey []byte // what the messages are encrypted with. See encryption.go
+
+	// sender keys. See senderkeys.go
+	outbound   *chain                     // ours
+	inbound    map[string][]*chain        // sender -> their chains, newest first
+	sharedWith map[string]bool            // participants who've said they have our current chain
+	replyKeys  map[string]*replyKeys      // participant -> the keys we've told them to seal theirs to
+	replyTo    map[string]*ecdh.PublicKey // participant -> the key they've told us to seal ours to
+	unsent     map[string]senderKey       // participant -> our chain as it was when they were first sent it, until they say they have it
+
 	trustedPeers []*kademlia.RemoteNode
 
 	valid bool
+
+	// delivery. See delivery.go
+	sequence uint64 // of the last message we sent
+	clock    uint64 // Lamport
+	senders  map[string]*senderState
+	log      []Message // in Lamport order
+	lock     sync.Mutex
+
+	// held while a text message is numbered and sealed, so our sender key is never handed out in between - whoever
+	// gets it would be told to expect the next sequence number, but be able to open the message before it
+	sending sync.Mutex
 }
 
 // Creates a chatroom, autogenerating all the keys for the chatroom
@@ -57,6 +86,7 @@ func createChatroom() *chatroom {
 	}
 
 	chatRoom := newChatroom(id, groupPriv, groupPriv.Group, memberPriv)
+	chatRoom.roomKey = newRoomKey()
 	chatRoom.valid = true
 
 	return chatRoom
@@ -66,6 +96,15 @@ func newChatroom(id string, groupKey *bbssig.PrivateKey, groupPublicKey *bbssig.
 	return &chatroom{
 		ID:           id,
 		participants: make(map[string]*net.UDPAddr),
+		publicKeys:   make(map[string]*rsa.PublicKey),
+		nicknames:    make(map[string]string),
+		handled:      make(map[string]bool),
+		managers:     make(map[string]*rsa.PublicKey),
+		inbound:      make(map[string][]*chain),
+		sharedWith:   make(map[string]bool),
+		replyKeys:    make(map[string]*replyKeys),
+		replyTo:      make(map[string]*ecdh.PublicKey),
+		unsent:       make(map[string]senderKey),
 
 		groupPrivateKey:  groupKey,
 		groupPublicKey:   groupPublicKey,
@@ -74,9 +113,36 @@ func newChatroom(id string, groupKey *bbssig.PrivateKey, groupPublicKey *bbssig.
 		trustedPeers: make([]*kademlia.RemoteNode, 0),
 
 		valid: false,
+
+		senders: make(map[string]*senderState),
 	}
 }
 
+// Participants returns a copy of the room's participants, to go through without holding the lock
+func (room *chatroom) Participants() map[string]*net.UDPAddr {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	retVal := make(map[string]*net.UDPAddr, len(room.participants))
+	for participant, address := range room.participants {
+		retVal[participant] = address
+	}
+	return retVal
+}
+
+func (room *chatroom) participant(participant string) (*net.UDPAddr, bool) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	address, ok := room.participants[participant]
+	return address, ok
+}
+
+func (room *chatroom) addParticipant(participant string, address *net.UDPAddr) {
+	room.lock.Lock()
+	room.participants[participant] = address
+	room.lock.Unlock()
+}
+
 // exports the keys of a chatroom.
 func (room *chatroom) ExportKeys() {
 	// public key of the room
@@ -87,19 +153,21 @@ func (room *chatroom) ExportKeys() {
 		log.Fatalf("Failed to open %s_public.pem for writing: %s", room.ID, err)
 		return
 	}
-	pem.Encode(publicPemFile, &pem.Block{Type: "GROUP PUBLIC KEY", Bytes: room.groupPrivateKey.Group.Marshal()})
+	pem.Encode(publicPemFile, &pem.Block{Type: "GROUP PUBLIC KEY", Bytes: room.groupPublicKey.Marshal()})
 	publicPemFile.Close()
 
-	// private key of the room - this is the key that allows creation of new members
-	privateFilename := fmt.Sprintf("chatrooms/%s_private.pem", room.ID)
-	privatePemFile, err := os.Create(privateFilename)
+	// private key of the room - this is the key that allows creation of new members. Only managers have it
+	if room.groupPrivateKey != nil {
+		privateFilename := fmt.Sprintf("chatrooms/%s_private.pem", room.ID)
+		privatePemFile, err := os.Create(privateFilename)
 
-	if err != nil {
-		log.Fatalf("Failed to open %s_private.pem for writing: %s", room.ID, err)
-		return
+		if err != nil {
+			log.Fatalf("Failed to open %s_private.pem for writing: %s", room.ID, err)
+			return
+		}
+		pem.Encode(privatePemFile, &pem.Block{Type: "GROUP PRIVATE KEY", Bytes: room.groupPrivateKey.Marshal()})
+		privatePemFile.Close()
 	}
-	pem.Encode(privatePemFile, &pem.Block{Type: "GROUP PRIVATE KEY", Bytes: room.groupPrivateKey.Marshal()})
-	privatePemFile.Close()
 
 	// a member's private key
 	memberFileName := fmt.Sprintf("keys/%s_member.pem", room.ID)
@@ -111,46 +179,35 @@ func (room *chatroom) ExportKeys() {
 	}
 	pem.Encode(memberPemFile, &pem.Block{Type: "MEMBER PRIVATE KEY", Bytes: room.memberPrivateKey.Marshal()})
 	memberPemFile.Close()
+
+	// the room key - what messages are encrypted with
+	if err := writeRoomKey(fmt.Sprintf("keys/%s_room.pem", room.ID), room.roomKey); err != nil {
+		log.Fatalf("Failed to write %s_room.pem: %s", room.ID, err)
+	}
+
+	// and who the managers are. See invites.go
+	if err := writeManagers(fmt.Sprintf("keys/%s_managers.pem", room.ID), room.managerIdentities()); err != nil {
+		log.Fatalf("Failed to write %s_managers.pem: %s", room.ID, err)
+	}
 }
 
 // RequestRoom sends a message via the Kademlia network, looking for nodes with the chatroom ID
 func (c *client) RequestRoom(ID string) {
-	// find a node with the chatroom id first
-	tmpRemote := c.Network.Node.GetNearestNode()
-	log.Printf("Nearest Node is: %#v\n", tmpRemote.ID)
-
-	if tmpRemote == nil {
+	if c.Network.Node.GetNearestNode() == nil {
 		c.ui <- "...No remote node found" // typically because well, the client is not connected to the kademlia network.
 		return
 	}
 
-	// issue FIND_VALUE
-	token := c.Network.FindValue(tmpRemote, ID)
-	ch, ok := c.Network.ResultChan[token]
-	defer delete(c.Network.ResultChan, token) // clean up after oneself
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
 
-	if !ok {
-		c.ui <- "...No result channel created for room request"
+	// find the members that have announced the chatroom id first
+	peers := c.Network.GetPeers(ctx, ID)
+	if len(peers) == 0 {
+		c.ui <- fmt.Sprintf("...Unable to find room %s on the network", ID)
 		return
 	}
 
-	var id kademlia.NodeID
-	tmp := <-ch
-	asBytes, ok := tmp.([]byte)
-
-	if !ok {
-		panic("SHIT SHIT")
-	}
-
-	err := msgpack.Unmarshal(asBytes, &id)
-	if err != nil {
-		c.ui <- fmt.Sprintf("...Unable to unmarshal. Error was: %s", err)
-		return
-	}
-
-	// found the ID? get the remoteNode so we can send it a message asking for a challenge
-	remote := c.Network.Node.GetNode(id)
-
 	// get the relevant room settings - member key
 	memberFileName := fmt.Sprintf("keys/%s_member.pem", ID)
 	memberPemData, err := ioutil.ReadFile(memberFileName)
@@ -190,9 +247,22 @@ func (c *client) RequestRoom(ID string) {
 		return
 	}
 
+	// get the relevant room settings - room key. Without it, the messages can't be read
+	roomKey, err := readRoomKey(fmt.Sprintf("keys/%s_room.pem", ID))
+	if err != nil {
+		c.ui <- fmt.Sprintf("...Unable to read the room key. It should be in keys/%s_room.pem. Error was: %s", ID, err)
+		return
+	}
+
+	// and who the managers are. Whoever lets us in can't tell us otherwise. See invites.go
+	managers, err := readManagers(fmt.Sprintf("keys/%s_managers.pem", ID))
+	if err != nil {
+		c.ui <- fmt.Sprintf("...Unable to read the room's managers. They should be in keys/%s_managers.pem. Error was: %s", ID, err)
+		return
+	}
+
 	// create a dummy chatroom. The dummy chatroom is required because to unmarshal the keys, a key is needed to begin with
 	chatRoom := createChatroom()
-	c.chatroomsID[ID] = chatRoom
 	chatRoom.ID = ID
 
 	group, success := chatRoom.groupPublicKey.Unmarshal(publicBlock.Bytes)
@@ -207,50 +277,135 @@ func (c *client) RequestRoom(ID string) {
 		return
 	}
 
-	// settings that are important to the challenge - these are dummy keys which are required to unmarshal
+	// settings that are important to the challenge - these are dummy keys which are required to unmarshal.
+	// We're joining as a member, not a manager, so there's no group private key
 	chatRoom.groupPublicKey = group
 	chatRoom.memberPrivateKey = memberPriv
+	chatRoom.groupPrivateKey = nil
+	chatRoom.roomKey = roomKey
+	for _, identity := range managers {
+		if err := chatRoom.addManager(string(nodeIDOf(identity)), identity); err != nil {
+			c.ui <- fmt.Sprintf("...Unable to take on a manager from keys/%s_managers.pem: %s", ID, err)
+			return
+		}
+	}
+	c.addRoom(chatRoom)
 
-	// send message
-	message, token := kademlia.NewMessage()
-	message.MessageType = "REQUEST_ROOM"
-	message.SourceID = c.Network.Node.ID
-	message.Message = ID
+	// any member that is online can challenge us, so try them in random order until one of them answers
+	for _, i := range mrand.Perm(len(peers)) {
+		peer := peers[i]
+
+		// every attempt is a new handshake, with a new ephemeral key. See handshake.go
+		ephemeral, err := newEphemeral()
+		if err != nil {
+			c.ui <- fmt.Sprintf("...Unable to generate an ephemeral key: %s", err)
+			return
+		}
+
+		// send message
+		message, token := kademlia.NewMessage()
+		message.MessageType = "REQUEST_ROOM"
+		message.SourceID = c.Network.Node.ID
+		message.InsertMessage(roomRequest{ID, ephemeral.PublicKey().Bytes()})
 
-	kademlia.SendMsg(c.Network.Connection, remote.Address, message)
+		// register things with the token so the reply knows wtf is going on
+		c.Network.SetExtraInfo(token, &joinRequest{roomID: ID, ephemeral: ephemeral})
 
-	// register things with the token so the reply knows wtf is going on
-	c.Network.AwaitingResponse[token] = time.Now()
-	c.Network.ExtraInfo[token] = ID
+		// the reply is the CHALLENGE, which is handled by challengeResponse
+		_, err = c.Network.Call(ctx, peer, message)
+		if err == nil {
+			return
+		}
+		c.Network.Forget(token)
+		c.ui <- fmt.Sprintf("...Room request to %s failed: %s", peer, err)
+	}
+	c.ui <- fmt.Sprintf("...None of the %d known members of room %s answered", len(peers), ID)
 }
 
 // issueChallenge is a kademlia.ResponseFunc, hence the elaborate signature
 // remote is the address on the envelope (i.e. the room requester)
 // c is the challenge issuer
 func (c *client) issueChallenge(remote *kademlia.RemoteNode, token string, source kademlia.NodeID, data interface{}) {
-	roomID, _ := data.(string)
-	// todo : what if data is not a string
+	b, _ := kademlia.Payload(data)
+	var req roomRequest
+	if err := msgpack.Unmarshal(b, &req); err != nil {
+		log.Printf("Unable to unmarshal room request from %s: %s", remote.Address, err)
+		return
+	}
+	roomID := req.RoomID
+	chatRoom, ok := c.room(roomID)
+	if !ok {
+		log.Printf("Room %s was requested, but we're not in it", roomID)
+		return
+	}
+
+	// the requester resends its request until it hears back. If it's already been challenged, it gets the same challenge
+	// again - that's the one we're waiting on an answer to
+	if info, ok := c.Network.GetExtraInfo(token); ok {
+		ch, ok := info.(*pendingChallenge)
+		if !ok || ch.RoomID != roomID || !bytes.Equal(ch.Requester, source) {
+			log.Printf("Room request from %s reuses a token that isn't its own", remote.Address)
+			return
+		}
+		message, _ := kademlia.NewMessage()
+		message.MessageType = "CHALLENGE"
+		message.SourceID = c.Network.Node.ID
+		message.InsertMessage(ch.sent)
+		message.Token = token
+		kademlia.SendMsg(c.Network.Transport, remote.Address, message)
+		return
+	}
+
+	// our half of the handshake. See handshake.go
+	ephemeral, err := newEphemeral()
+	if err != nil {
+		log.Printf("Unable to generate an ephemeral key: %s", err)
+		return
+	}
+	session, err := newSession(roomID, ephemeral, req.Ephemeral, false)
+	if err != nil {
+		log.Printf("Handshake with %s for %s failed: %s", remote.Address, roomID, err)
+		return
+	}
+	sig, err := session.signTranscript(chatRoom.memberPrivateKey)
+	if err != nil {
+		log.Printf("Unable to sign the handshake for %s: %s", roomID, err)
+		return
+	}
+
+	// a fresh challenge for every request. See challenge.go
+	ch, err := newChallenge(roomID, source, c.Network.Node.ID, session)
+	if err != nil {
+		log.Printf("Unable to make a challenge for %s: %s", roomID, err)
+		return
+	}
+	ch.sent = sealedChallenge{ephemeral.PublicKey().Bytes(), sig, session.seal(session.toRequest, NONCE_CHALLENGE, ch.raw)}
 
 	message, _ := kademlia.NewMessage()
 	message.MessageType = "CHALLENGE"
 	message.SourceID = c.Network.Node.ID
-	message.Message = roomID
+	message.InsertMessage(ch.sent)
 	message.Token = token
 
-	kademlia.SendMsg(c.Network.Connection, remote.Address, message)
+	c.Network.SetExtraInfo(token, ch)
 
-	c.Network.AwaitingResponse[token] = time.Now()
-	c.Network.ExtraInfo[token] = roomID
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
 
+	// the reply is the CHALLENGE_RESPONSE, which is handled by verifyChallengeResponse
+	if _, err := c.Network.Call(ctx, remote.Address, message); err != nil {
+		log.Printf("Challenge for %s was not answered: %s", roomID, err)
+	}
 }
 
 type answerPacket struct {
 	ChallengeAnswer string
 	Port            int
+	Identity        []byte // the requester's public key, so it can be sent new keys if the room is rekeyed
 }
 
-func answerChallenge(message string, memberKey *bbssig.MemberKey) string {
-	out, err := memberKey.Sign(rand.Reader, []byte(message), sha1.New())
+func answerChallenge(raw []byte, memberKey *bbssig.MemberKey) string {
+	out, err := memberKey.Sign(rand.Reader, challengeDigest(raw), sha256.New())
 	if err != nil {
 		log.Printf("Challenge failed. Error was: %s\n", err)
 	}
@@ -262,73 +417,145 @@ func answerChallenge(message string, memberKey *bbssig.MemberKey) string {
 // remote is the challenge issuer
 // c is the room requester
 func (c *client) challengeResponse(remote *kademlia.RemoteNode, token string, source kademlia.NodeID, data interface{}) {
-	// no deleting from AwaitingResponse because the process is not complete yet
+	b, ok := kademlia.Payload(data)
+	if !ok {
+		log.Printf("Challenge from %s is not bytes", remote.Address)
+		return
+	}
+
+	var sealed sealedChallenge
+	if err := msgpack.Unmarshal(b, &sealed); err != nil {
+		log.Printf("Unable to unmarshal challenge from %s: %s", remote.Address, err)
+		return
+	}
 
-	roomID, ok := data.(string)
+	info, _ := c.Network.GetExtraInfo(token)
+	join, ok := info.(*joinRequest)
 	if !ok {
-		panic("data is not a string. No Room ID")
+		log.Printf("Challenge from %s isn't for any room we asked for", remote.Address)
+		return
 	}
+	roomID := join.roomID
 
-	chatRoom, ok := c.chatroomsID[roomID]
+	chatRoom, ok := c.room(roomID)
 	if !ok {
-		log.Printf("Chatroom not found when responding to challenge. ID: %#v\n", c.chatroomsID)
+		log.Printf("Chatroom not found when responding to challenge. ID: %s\n", roomID)
 		c.ui <- "...Chatroom not found when responding to challenge"
 		return
 	}
 
-	answer := answerChallenge(roomID, chatRoom.memberPrivateKey)
+	// finish the key agreement, and make sure it's with a member of the room
+	session, err := newSession(roomID, join.ephemeral, sealed.Ephemeral, true)
+	if err == nil && !session.verifyTranscript(chatRoom.groupPublicKey, sealed.Signature) {
+		err = errBadHandshake
+	}
+	var raw []byte
+	if err == nil {
+		raw, err = session.open(session.toRequest, NONCE_CHALLENGE, sealed.Sealed)
+	}
+	if err != nil {
+		log.Printf("Handshake with %s for %s failed: %s", remote.Address, roomID, err)
+		c.ui <- fmt.Sprintf("...Handshake for room %s failed. %s may not be a member, or someone's in the middle", roomID, remote.Address)
+		return
+	}
+
+	var ch challenge
+	if err := msgpack.Unmarshal(raw, &ch); err != nil {
+		log.Printf("Unable to unmarshal challenge from %s: %s", remote.Address, err)
+		return
+	}
+
+	// the challenge has to be for the room we asked for, for us, from whoever sent it, and part of this handshake -
+	// otherwise we could be made to answer someone else's challenge
+	if err := ch.check(roomID, c.Node.ID, source, session); err != nil {
+		log.Printf("Refused to answer the challenge from %s: %s", remote.Address, err)
+		c.ui <- fmt.Sprintf("...Refused to answer a challenge for room %s: %s", roomID, err)
+		return
+	}
+	join.session = session
+
+	answer := answerChallenge(raw, chatRoom.memberPrivateKey)
+	b, err = msgpack.Marshal(answerPacket{answer, c.port, c.identity})
+	if err != nil {
+		log.Printf("Unable to marshal the challenge response: %s", err)
+		return
+	}
 
 	message, _ := kademlia.NewMessage()
 	message.MessageType = "CHALLENGE_RESPONSE"
 	message.SourceID = c.Network.Node.ID
-	message.InsertMessage(answerPacket{answer, c.port})
+	message.InsertMessage(session.seal(session.toIssuer, NONCE_RESPONSE, b))
 	message.Token = token
 
-	kademlia.SendMsg(c.Network.Connection, remote.Address, message)
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
 
-	// update last response time
-	c.Network.AwaitingResponse[token] = time.Now()
+	// the reply is either ADMITTED (handled by admitted) or FAILED_CHALLENGE
+	call, err := c.Network.Call(ctx, remote.Address, message)
+	switch {
+	case err == kademlia.ErrTokenInUse:
+		// the challenge was resent, and we're still waiting on the answer to the first one
+	case err != nil:
+		c.ui <- fmt.Sprintf("...No answer to the challenge response: %s", err)
+	case call.ReplyType == "FAILED_CHALLENGE":
+		c.ui <- fmt.Sprintf("...Failed the challenge for room %s", roomID)
+	}
 }
 
+// validChallengeResponse is what a requester is told on being admitted to a room. There are no keys in it - the requester
+// came with everything a member needs, and the group private key stays with the managers
 type validChallengeResponse struct {
 	ChatroomID   string
-	PrivateKey   []byte
 	Name         string
 	Port         int
 	Participants map[string]*net.UDPAddr
+	Identities   map[string][]byte // node ID -> public key, of the participants the challenge issuer knows of
+	Managers     map[string][]byte // node ID -> public key. They're who to ask for invites, and the only ones who can rekey
 }
 
 // verifyChallengeResponse is a kademlia.ResponseFunc, hence the elaborate signature
 // remote is the room requester
 // c is the challenge issuer, and also the verifier
 func (c *client) verifyChallengeResponse(remote *kademlia.RemoteNode, token string, source kademlia.NodeID, data interface{}) {
-	defer delete(c.Network.AwaitingResponse, token)
-	defer delete(c.Network.ExtraInfo, token)
+	defer c.Network.Forget(token)
 
-	response, ok := data.(string)
+	// there's only one go at a challenge: it's taken, so a second response (or a replayed one) finds nothing
+	info, _ := c.Network.TakeExtraInfo(token)
+	ch, ok := info.(*pendingChallenge)
 	if !ok {
-		// shit
+		log.Printf("Challenge response from %s doesn't answer any challenge we're waiting on", remote.Address)
+		return
+	}
+	chatRoomID := ch.RoomID
+	chatRoom, ok := c.room(chatRoomID)
+	if !ok {
+		return
 	}
 
+	// the response is sealed with the session key. Anything that doesn't open is a failed challenge
 	var answer answerPacket
-	err := msgpack.Unmarshal([]byte(response), &answer)
-
-	if err != nil {
-		// shit - TODO
+	var response []byte
+	b, _ := kademlia.Payload(data)
+	err := msgpack.Unmarshal(b, &response)
+	if err == nil {
+		response, err = ch.session.open(ch.session.toIssuer, NONCE_RESPONSE, response)
 	}
-
-	chatRoomID, ok := c.Network.ExtraInfo[token].(string)
-	if !ok {
-		// shit - TODO
+	if err == nil {
+		err = msgpack.Unmarshal(response, &answer)
 	}
-	chatRoom := c.chatroomsID[chatRoomID]
 
-	valid := chatRoom.groupPrivateKey.Group.Verify([]byte(chatRoomID), sha1.New(), []byte(answer.ChallengeAnswer))
+	valid := err == nil && ch.check(chatRoomID, source, c.Node.ID, ch.session) == nil &&
+		chatRoom.groupPublicKey.Verify(challengeDigest(ch.raw), sha256.New(), []byte(answer.ChallengeAnswer))
 
+	// the requester's node ID has to be the one made from their identity. See nodeIDOf
 	if valid {
-		// send group private key to user
-		groupPriv := pem.EncodeToMemory(&pem.Block{Type: "GROUP PRIVATE KEY", Bytes: chatRoom.groupPrivateKey.Marshal()})
+		if err := chatRoom.bindIdentity(string(source), answer.Identity); err != nil {
+			log.Printf("Refused %x into %s: %s", source, chatRoomID, err)
+			valid = false
+		}
+	}
 
+	if valid {
 		r := c.Network.Node.GetNode(source)
 		if r == nil {
 			// shit
@@ -337,18 +564,24 @@ func (c *client) verifyChallengeResponse(remote *kademlia.RemoteNode, token stri
 		address := *remote.Address
 		address.Port = answer.Port
 
-		chatRoom.participants[string(source)] = &address
+		chatRoom.addParticipant(string(source), &address)
 
-		msg := validChallengeResponse{chatRoomID, groupPriv, chatRoom.Name, c.port, chatRoom.participants}
+		msg := validChallengeResponse{chatRoomID, chatRoom.Name, c.port, chatRoom.Participants(), c.identities(chatRoom), chatRoom.Managers()}
 		message, _ := kademlia.NewMessage()
-		message.MessageType = "GROUP_PRIVATE_KEY"
+		message.MessageType = "ADMITTED"
 		message.SourceID = c.Network.Node.ID
 		message.Token = token
-		message.InsertMessage(msg)
+		b, _ := msgpack.Marshal(msg)
+		message.InsertMessage(ch.session.seal(ch.session.toRequest, NONCE_ADMITTED, b))
 
-		kademlia.SendMsg(c.Network.Connection, remote.Address, message)
+		kademlia.SendMsg(c.Network.Transport, remote.Address, message)
 
 		chatRoom.trustedPeers = append(chatRoom.trustedPeers, r)
+
+		// they'll need our sender key to read anything we send
+		if err := c.shareSenderKey(chatRoom, string(source)); err != nil {
+			log.Printf("Unable to send our sender key for %s to %x. Error was: %s", chatRoomID, source, err)
+		}
 		return
 	}
 
@@ -357,64 +590,74 @@ func (c *client) verifyChallengeResponse(remote *kademlia.RemoteNode, token stri
 	message.SourceID = c.Network.Node.ID
 	message.Token = token
 
-	kademlia.SendMsg(c.Network.Connection, remote.Address, message)
+	kademlia.SendMsg(c.Network.Transport, remote.Address, message)
 
 }
 
-// receiveGroupPrivateKey is a kademlia.ResponseFunc, hence the elaborate signature
+// admitted is a kademlia.ResponseFunc, hence the elaborate signature
 // remote is the challenge issuer
 // c is the room requester
 
-func (c *client) receiveGroupPrivateKey(remote *kademlia.RemoteNode, token string, source kademlia.NodeID, data interface{}) {
+func (c *client) admitted(remote *kademlia.RemoteNode, token string, source kademlia.NodeID, data interface{}) {
 	// this is the last step of all the pingponging.  Hence the cleanup
-	defer delete(c.Network.AwaitingResponse, token)
-	defer delete(c.Network.ExtraInfo, token)
+	defer c.Network.Forget(token)
 
-	response, ok := data.(string)
-	if !ok {
-		//shit
+	info, ok := c.Network.GetExtraInfo(token)
+	if !ok { // means it's been cleaned up. This request shouldn't have happened
+		c.ui <- "...Network error. ExtraInfo has no key. This usually means this is a duplicate request"
+		return
+	}
+	join, ok := info.(*joinRequest)
+	if !ok || join.session == nil {
+		log.Printf("ADMITTED from %s before the handshake was done", remote.Address)
+		return
+	}
+
+	// it's sealed with the session key from the handshake
+	var asBytes []byte
+	b, _ := kademlia.Payload(data)
+	err := msgpack.Unmarshal(b, &asBytes)
+	if err == nil {
+		asBytes, err = join.session.open(join.session.toRequest, NONCE_ADMITTED, asBytes)
+	}
+	if err != nil {
+		c.ui <- fmt.Sprintf("...Unable to open the room details from %s: %s", remote.Address, err)
+		return
 	}
-	asBytes := []byte(response)
 
 	var valid validChallengeResponse
-	err := msgpack.Unmarshal(asBytes, &valid)
+	err = msgpack.Unmarshal(asBytes, &valid)
 
 	if err != nil {
 		//shit
-	}
-
-	chatRoomIDIface, ok := c.Network.ExtraInfo[token]
-	if !ok { // means it's been cleaned up. This request shouldn't have happened
-		c.ui <- "...Network error. ExtraInfo has no key. This usually means this is a duplicate request"
+		c.ui <- fmt.Sprintf("...Unable to unmarshal the room details from %s: %s", remote.Address, err)
 		return
 	}
-	chatRoomID, ok := chatRoomIDIface.(string)
-	if !ok {
-		panic("chatroomID not a string??!")
-	}
-	chatRoom, ok := c.chatroomsID[chatRoomID]
+
+	chatRoomID := join.roomID
+	chatRoom, ok := c.room(chatRoomID)
 	if !ok {
 		c.ui <- "...No chatroom found"
 		return
 	}
 
-	// start decoding and unmarshalling the private key
-	block, _ := pem.Decode(valid.PrivateKey)
-	if block == nil {
-		c.ui <- "Block is not a pem"
-		return
-	}
-
-	groupPriv, success := chatRoom.groupPrivateKey.Unmarshal(chatRoom.groupPublicKey, block.Bytes)
-	if !success {
-		c.ui <- "...Unable to succesfully unmarshal private key"
+	// the managers came with our invite. Anyone else named as one means whoever let us in isn't to be trusted
+	if err := chatRoom.checkManagers(valid.Managers); err != nil {
+		log.Printf("Refused the room details from %s for %s: %s", remote.Address, chatRoomID, err)
+		c.ui <- fmt.Sprintf("...Refused the room details from %s. They %s", remote.Address, err)
 		return
 	}
 
 	// apply them to the chatroom
-	chatRoom.groupPrivateKey = groupPriv
-	chatRoom.Name = valid.Name
-	chatRoom.participants = valid.Participants
+	c.nameRoom(chatRoom, valid.Name)
+	for participant, address := range valid.Participants {
+		chatRoom.addParticipant(participant, address)
+	}
+	for participant, identity := range valid.Identities {
+		if err := chatRoom.bindIdentity(participant, identity); err != nil {
+			log.Printf("Unable to take on the identity of %x in %s: %s", participant, chatRoomID, err)
+		}
+	}
 
 	// when the participants list is sent from the challenge issuer to the room requester,
 	// the challenge issuer's own IP will be 0.0.0.0.
@@ -429,44 +672,66 @@ func (c *client) receiveGroupPrivateKey(remote *kademlia.RemoteNode, token strin
 	newAddress := *sourceNode.Address
 	newAddress.Port = valid.Port
 
-	lA := c.connection.LocalAddr()
-	localAddr, _ := lA.(*net.UDPAddr)
+	localAddr := c.transport.LocalAddr()
 
-	chatRoom.participants[string(source)] = &newAddress
+	chatRoom.addParticipant(string(source), &newAddress)
 
 	// fixes  it so that the local node is 0.0.0.0:xxxx - this is an issue only in OS X,  doesn't matter what the self-IP is for linux
-	chatRoom.participants[string(c.Node.ID)] = localAddr
+	chatRoom.addParticipant(string(c.Node.ID), localAddr)
+
+	// store chatroom ID on kademlia. Every member does this, so the room can still be found when the creator is gone
+	c.announceRoom(chatRoom.ID)
 
-	c.chatroomsName[valid.Name] = chatRoom
+	// and let everyone know we're here, with our sender key. They send theirs back
+	c.shareSenderKeys(chatRoom)
+}
 
-	// store chatroom ID on kademlia
-	c.Network.LocalStore(chatRoom.ID, c.Node.ID)
+// announceRoom announces this node as a member of the room on the k closest nodes to the room ID.
+// The kademlia network reannounces it for as long as this node is alive
+func (c *client) announceRoom(roomID string) {
+	n := c.Network.AnnouncePeer(context.Background(), roomID, 0)
+	c.ui <- fmt.Sprintf("...Room %s announced to %d nodes", roomID, n)
 }
 
-// Generates pem files and stores them in invites/.
-func (room *chatroom) GenerateInvite() {
-	newMember, err := room.groupPrivateKey.NewMember(rand.Reader)
+// Generates pem files and stores them in invites/. Who the invite is for is written down, so their messages can be traced
+// back to them if need be. See moderation.go. Only managers can do this - members have to ask one (see invites.go)
+func (room *chatroom) GenerateInvite(issuedTo string) {
+	newMember, err := room.mintMember(issuedTo)
 	if err != nil {
 		// shit
+		log.Printf("Unable to make an invite to %s: %s", room.ID, err)
+		return
 	}
+	writeInvite(room.ID, room.groupPublicKey, newMember, room.roomKey, room.managerIdentities())
+}
 
-	publicFilename := fmt.Sprintf("invites/%s_public.pem", room.ID)
+// writeInvite writes out the pem files of an invite to invites/
+func writeInvite(roomID string, group *bbssig.Group, newMember *bbssig.MemberKey, roomKey []byte, managers [][]byte) {
+	publicFilename := fmt.Sprintf("invites/%s_public.pem", roomID)
 	publicPemFile, err := os.Create(publicFilename)
 
 	if err != nil {
-		log.Fatalf("Failed to open %s_public.pem for writing: %s", room.ID, err)
+		log.Fatalf("Failed to open %s_public.pem for writing: %s", roomID, err)
 		return
 	}
-	pem.Encode(publicPemFile, &pem.Block{Type: "GROUP PUBLIC KEY", Bytes: room.groupPrivateKey.Group.Marshal()})
+	pem.Encode(publicPemFile, &pem.Block{Type: "GROUP PUBLIC KEY", Bytes: group.Marshal()})
 	publicPemFile.Close()
 
-	memberFileName := fmt.Sprintf("invites/%s_member.pem", room.ID)
+	memberFileName := fmt.Sprintf("invites/%s_member.pem", roomID)
 	memberPemFile, err := os.Create(memberFileName)
 
 	if err != nil {
-		log.Fatalf("Failed to open %s_member.pem for writing: %s", room.ID, err)
+		log.Fatalf("Failed to open %s_member.pem for writing: %s", roomID, err)
 		return
 	}
 	pem.Encode(memberPemFile, &pem.Block{Type: "MEMBER PRIVATE KEY", Bytes: newMember.Marshal()})
 	memberPemFile.Close()
+
+	if err := writeRoomKey(fmt.Sprintf("invites/%s_room.pem", roomID), roomKey); err != nil {
+		log.Fatalf("Failed to write %s_room.pem: %s", roomID, err)
+	}
+
+	if err := writeManagers(fmt.Sprintf("invites/%s_managers.pem", roomID), managers); err != nil {
+		log.Fatalf("Failed to write %s_managers.pem: %s", roomID, err)
+	}
 }
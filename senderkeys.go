@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack"
+)
+
+// sender keys: text messages aren't sealed with the room key, but with a key that's only ever used once. Every participant
+// has their own chain of them - a chain key, which is hashed into the key for the next message, and then hashed into the
+// next chain key. The old chain key and the message key are thrown away as soon as they're used, so whoever gets hold of a
+// device later on can't work out the keys of anything that's already been sent or read.
+//
+// Each participant sends their chain key (and how far along it is) to every other participant on their own, as a signed
+// room message. Whenever someone's kicked out, everyone staying starts a new chain and sends it to the others, so whoever's
+// been kicked out can't follow along any more. Someone who's new is just sent the chain where it's at, which can't be wound
+// back to anything sent before.
+//
+// The chain key isn't encrypted to anyone's identity key, as that would never be thrown away. Instead every grant carries
+// a throwaway X25519 key (ReplyTo) for the other to seal theirs to. A chain key is sealed with a key agreed between a fresh
+// X25519 key of ours, which is dropped straight after, and the last ReplyTo the receiver sent. Once something sealed to
+// a ReplyTo is opened, the receiver makes a new one for next time, and drops the one before (see takeReplyKey). Both ends
+// are signed, as the grants are in messages signed with the identity key. The first grant either way can't be sealed, as
+// there's nothing to seal it to yet: it just carries a ReplyTo, and the chain follows. Neither can a grant sealed to a
+// ReplyTo that's already been dropped - the receiver asks for it again, with NeedKey.
+//
+// Every grant also says which of the receiver's chains the sender has (Have). Until the receiver's heard that they have
+// our chain, we hold on to it as it was when they were first sent it (unsent), so whatever we've sent since can be read
+// once they do
+//
+// The room key is still used for everything else (rekeys, invite requests, the sender keys themselves)
+const (
+	CHAIN_KEY_SIZE    = 32
+	MAX_CHAINS        = 2    // per sender: the one in use, and the one before, for messages that were on their way when it changed
+	MAX_SKIPPED_KEYS  = 1000 // per chain. Messages can arrive out of order, so keys that are skipped over are kept until they're used
+	MESSAGE_KEY_LABEL = 1
+	CHAIN_KEY_LABEL   = 2
+
+	SENDER_KEY_PROTOCOL = "nanjingtaxi sender key v1"
+)
+
+var (
+	errNoSenderKey = errors.New("no sender key for that message yet")
+	errKeyUsed     = errors.New("the key for that message has already been used, or was skipped over too long ago")
+	errTooFarAhead = fmt.Errorf("message is more than %d messages ahead of the chain", MAX_SKIPPED_KEYS)
+	errNoReplyKey  = errors.New("sender key is sealed to a key we don't have (any more)")
+	errNotForUs    = errors.New("sender key is for someone else")
+)
+
+// chain is one participant's chain of message keys
+type chain struct {
+	ID         string
+	key        []byte
+	generation uint32            // of the next message key
+	skipped    map[uint32][]byte // message keys that were skipped over. Only for chains we receive on
+}
+
+// senderKey is a chain, as it's sent to the other participants
+type senderKey struct {
+	Chain      string
+	ChainKey   []byte
+	Generation uint32
+	Sequence   uint64 // of the next text message we'll send. See expect
+}
+
+// senderKeyGrant is what SenderKeyMessage carries, to one participant. Sealed is the senderKey, sealed to SealedTo (the
+// last ReplyTo they sent us) with Ephemeral. It's empty if they haven't sent us a ReplyTo yet - they'll send theirs,
+// and we'll send ours back. NeedKey asks for theirs again, if the one they sent couldn't be opened. Have is the newest of
+// their chains we have
+type senderKeyGrant struct {
+	To        string
+	ReplyTo   []byte
+	Ephemeral []byte
+	SealedTo  []byte
+	Sealed    []byte
+	NeedKey   bool
+	Have      string
+}
+
+// grantKey works out the key a grant is sealed with, from the X25519 shared secret. HKDF (RFC 5869), like the handshake,
+// salted with who it's from and to and both public keys, so it can't be passed off as anyone else's
+func grantKey(shared []byte, roomID, from, to string, ephemeral, sealedTo []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(SENDER_KEY_PROTOCOL))
+	h.Write([]byte(roomID))
+	h.Write([]byte(from))
+	h.Write([]byte(to))
+	h.Write(ephemeral)
+	h.Write(sealedTo)
+
+	extract := hmac.New(sha256.New, h.Sum(nil))
+	extract.Write(shared)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte("sender key"))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// sealGrant seals b to their reply key, with an ephemeral key that's dropped as soon as it's done
+func sealGrant(roomID, from, to string, theirs *ecdh.PublicKey, b []byte) (ephemeral, sealed []byte, err error) {
+	ours, err := newEphemeral()
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := ours.ECDH(theirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(shared)
+	ephemeral = ours.PublicKey().Bytes()
+
+	key := grantKey(shared, roomID, from, to, ephemeral, theirs.Bytes())
+	defer wipe(key)
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the key's never used again, so the nonce can be all zeroes
+	return ephemeral, aead.Seal(nil, make([]byte, aead.NonceSize()), b, nil), nil
+}
+
+// openGrant opens a grant sealed to one of our reply keys
+func openGrant(roomID, from, to string, ours *ecdh.PrivateKey, grant senderKeyGrant) ([]byte, error) {
+	theirs, err := ecdh.X25519().NewPublicKey(grant.Ephemeral)
+	if err != nil {
+		return nil, errTampered
+	}
+	shared, err := ours.ECDH(theirs)
+	if err != nil {
+		return nil, errTampered
+	}
+	defer wipe(shared)
+
+	key := grantKey(shared, roomID, from, to, grant.Ephemeral, grant.SealedTo)
+	defer wipe(key)
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := aead.Open(nil, make([]byte, aead.NonceSize()), grant.Sealed, nil)
+	if err != nil {
+		return nil, errTampered
+	}
+	return b, nil
+}
+
+// replyKeys are the keys one participant is to seal their chains to
+type replyKeys struct {
+	current  *ecdh.PrivateKey // what we tell them to seal to. A new one's made once it's used
+	previous *ecdh.PrivateKey // the last one used, for grants that were sealed to it before they heard of the new one
+}
+
+// replyKey is the key the participant is to seal their chain to
+func (room *chatroom) replyKey(participant string) (*ecdh.PrivateKey, error) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	keys, ok := room.replyKeys[participant]
+	if !ok {
+		keys = new(replyKeys)
+		room.replyKeys[participant] = keys
+	}
+	if keys.current == nil {
+		key, err := newEphemeral()
+		if err != nil {
+			return nil, err
+		}
+		keys.current = key
+	}
+	return keys.current, nil
+}
+
+// takeReplyKey gets the reply key a grant from the participant was sealed to. Once the current one's used, the one
+// before it is dropped - so a key is only around until they've used the next one
+func (room *chatroom) takeReplyKey(participant string, pub []byte) (*ecdh.PrivateKey, bool) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	keys, ok := room.replyKeys[participant]
+	switch {
+	case !ok:
+		return nil, false
+	case keys.current != nil && bytes.Equal(keys.current.PublicKey().Bytes(), pub):
+		key := keys.current
+		keys.previous, keys.current = key, nil
+		return key, true
+	case keys.previous != nil && bytes.Equal(keys.previous.PublicKey().Bytes(), pub):
+		return keys.previous, true
+	}
+	return nil, false
+}
+
+func newChain() *chain {
+	return &chain{ID: uuid.New().String(), key: newRoomKey(), skipped: make(map[uint32][]byte)}
+}
+
+func ratchet(key []byte, label byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{label})
+	return mac.Sum(nil)
+}
+
+// wipe overwrites a key that's not going to be used again
+func wipe(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
+
+// advance returns the message key for the current generation, and moves the chain on. The old chain key is wiped
+func (ch *chain) advance() []byte {
+	messageKey := ratchet(ch.key, MESSAGE_KEY_LABEL)
+	next := ratchet(ch.key, CHAIN_KEY_LABEL)
+	wipe(ch.key)
+	ch.key = next
+	ch.generation++
+	return messageKey
+}
+
+// wipe overwrites all the chain's keys, when it's not going to be used again
+func (ch *chain) wipe() {
+	wipe(ch.key)
+	for _, messageKey := range ch.skipped {
+		wipe(messageKey)
+	}
+}
+
+func (ch *chain) copy() *chain {
+	retVal := &chain{ID: ch.ID, key: append([]byte(nil), ch.key...), generation: ch.generation, skipped: make(map[uint32][]byte)}
+	for n, key := range ch.skipped {
+		retVal.skipped[n] = key
+	}
+	return retVal
+}
+
+// keyFor works out the message key for generation n, without using it up. The chain as it would be once the key's been
+// used is returned as well - it's only kept if the message opens
+func (ch *chain) keyFor(n uint32) (messageKey []byte, after *chain, err error) {
+	if messageKey, ok := ch.skipped[n]; ok {
+		after = ch.copy()
+		delete(after.skipped, n)
+		return messageKey, after, nil
+	}
+	if n < ch.generation {
+		return nil, nil, errKeyUsed
+	}
+	if uint64(n-ch.generation)+uint64(len(ch.skipped)) > MAX_SKIPPED_KEYS {
+		return nil, nil, errTooFarAhead
+	}
+
+	after = ch.copy()
+	for after.generation < n {
+		skipped := after.generation
+		after.skipped[skipped] = after.advance()
+	}
+	return after.advance(), after, nil
+}
+
+// sendingChain is our chain, which is started if there isn't one. It's called with the lock held
+func (room *chatroom) sendingChain() *chain {
+	if room.outbound == nil {
+		room.outbound = newChain()
+		room.sharedWith = make(map[string]bool)
+	}
+	return room.outbound
+}
+
+// sealText seals a text message with the next key off our chain
+func (room *chatroom) sealText(msg Message) (Message, error) {
+	room.lock.Lock()
+	ch := room.sendingChain()
+	msg.Chain = ch.ID
+	msg.Generation = ch.generation
+	messageKey := ch.advance()
+	room.lock.Unlock()
+
+	defer wipe(messageKey)
+	return sealUnder(messageKey, msg)
+}
+
+// openText opens a text message with the key off the sender's chain. The key's gone afterwards, so each message can
+// only be opened once - see seen for how resends are dealt with. Everyone the sender's chain has gone to could seal a
+// message with it, so the key's only used up if what's inside is signed by the sender's identity
+func (room *chatroom) openText(msg Message) (Message, error) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	var ch *chain
+	for _, candidate := range room.inbound[msg.Sender] {
+		if candidate.ID == msg.Chain {
+			ch = candidate
+		}
+	}
+	if ch == nil {
+		return msg, errNoSenderKey
+	}
+
+	messageKey, after, err := ch.keyFor(msg.Generation)
+	if err != nil {
+		return msg, err
+	}
+
+	opened, err := openUnder(messageKey, msg)
+	if err == nil {
+		err = verifyIdentity(opened)
+	}
+	if err != nil {
+		return msg, err
+	}
+	wipe(messageKey)
+	wipe(ch.key)
+	*ch = *after
+	return opened, nil
+}
+
+// addChain takes on a chain someone sent us, and says whether it's new. The oldest one is dropped if there are too many
+func (room *chatroom) addChain(sender string, sk senderKey) bool {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	for _, ch := range room.inbound[sender] {
+		if ch.ID == sk.Chain {
+			return false // already have it. A chain is never wound back
+		}
+	}
+
+	chains := append([]*chain{{ID: sk.Chain, key: sk.ChainKey, generation: sk.Generation, skipped: make(map[uint32][]byte)}}, room.inbound[sender]...)
+	if len(chains) > MAX_CHAINS {
+		for _, ch := range chains[MAX_CHAINS:] {
+			ch.wipe()
+		}
+		chains = chains[:MAX_CHAINS]
+	}
+	room.inbound[sender] = chains
+	return true
+}
+
+// newestChain is the ID of the last chain the sender sent us, if there is one
+func (room *chatroom) newestChain(sender string) string {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	if chains := room.inbound[sender]; len(chains) > 0 {
+		return chains[0].ID
+	}
+	return ""
+}
+
+// confirm takes note that the participant has our chain, and so doesn't need it held for them any more
+func (room *chatroom) confirm(participant, have string) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	if room.outbound == nil || room.outbound.ID != have {
+		return
+	}
+	room.sharedWith[participant] = true
+	if sk, ok := room.unsent[participant]; ok {
+		wipe(sk.ChainKey)
+		delete(room.unsent, participant)
+	}
+}
+
+// hasOurKey says whether the participant has said they have our current chain
+func (room *chatroom) hasOurKey(participant string) bool {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	return room.outbound != nil && room.sharedWith[participant]
+}
+
+// shareSenderKey sends our chain, where it's at right now, to the participant
+func (c *client) shareSenderKey(room *chatroom, participant string) error {
+	return c.grantSenderKey(room, participant, false)
+}
+
+// grantSenderKey sends our chain to the participant, sealed to the last reply key they sent us - or if there isn't
+// one, just a reply key, so they can send one back. needKey asks for theirs
+func (c *client) grantSenderKey(room *chatroom, participant string, needKey bool) error {
+	room.sending.Lock()
+	room.lock.Lock()
+	address, ok := room.participants[participant]
+	if !ok {
+		room.lock.Unlock()
+		room.sending.Unlock()
+		return fmt.Errorf("%x is not in %s", participant, room.Name)
+	}
+	theirs, known := room.replyTo[participant]
+	// until they say they have it, they're sent the chain as it was the first time, so whatever's been sent since
+	// can be read once they do
+	ch := room.sendingChain()
+	sk, held := room.unsent[participant]
+	if !held || sk.Chain != ch.ID {
+		if held {
+			wipe(sk.ChainKey)
+		}
+		sk = senderKey{ch.ID, append([]byte(nil), ch.key...), ch.generation, room.sequence + 1}
+		if !room.sharedWith[participant] {
+			room.unsent[participant] = sk
+		}
+	}
+	sk.ChainKey = append([]byte(nil), sk.ChainKey...) // it's wiped as soon as they say they have it
+	room.lock.Unlock()
+	room.sending.Unlock()
+	defer wipe(sk.ChainKey)
+
+	replyKey, err := room.replyKey(participant)
+	if err != nil {
+		return err
+	}
+	grant := senderKeyGrant{To: participant, ReplyTo: replyKey.PublicKey().Bytes(), NeedKey: needKey, Have: room.newestChain(participant)}
+	if known {
+		b, err := msgpack.Marshal(sk)
+		if err != nil {
+			return err
+		}
+		defer wipe(b)
+		if grant.Ephemeral, grant.Sealed, err = sealGrant(room.ID, string(c.Node.ID), participant, theirs, b); err != nil {
+			return err
+		}
+		grant.SealedTo = theirs.Bytes()
+	}
+
+	msg, err := c.newControl(room, SenderKeyMessage, grant)
+	if err != nil {
+		return err
+	}
+	if msg, err = c.secure(room, msg); err != nil {
+		return err
+	}
+	go c.sendReliably(participant, address, msg)
+	return nil
+}
+
+// shareSenderKeys sends our chain to every participant who hasn't said they have it yet
+func (c *client) shareSenderKeys(room *chatroom) {
+	for participant := range room.Participants() {
+		if participant == string(c.Node.ID) || room.hasOurKey(participant) {
+			continue
+		}
+		if err := c.shareSenderKey(room, participant); err != nil {
+			log.Printf("Unable to send our sender key for %s to %x. Error was: %s", room.ID, participant, err)
+		}
+	}
+}
+
+// rotateSenderKey starts us on a new chain, and sends it to everyone in the room. Whoever's left only has the old one
+func (c *client) rotateSenderKey(room *chatroom) {
+	room.lock.Lock()
+	if room.outbound != nil {
+		room.outbound.wipe()
+	}
+	room.outbound = nil
+	for participant, sk := range room.unsent {
+		wipe(sk.ChainKey)
+		delete(room.unsent, participant)
+	}
+	room.lock.Unlock()
+
+	c.shareSenderKeys(room)
+}
+
+// senderKeyed takes on the chain someone sent us, and sends ours back if they don't have it, or need a reply key
+func (c *client) senderKeyed(room *chatroom, msg Message, from *net.UDPAddr) error {
+	var grant senderKeyGrant
+	if err := msgpack.Unmarshal(msg.Message, &grant); err != nil {
+		return err
+	}
+	if grant.To != string(c.Node.ID) {
+		return errNotForUs
+	}
+	replyTo, err := ecdh.X25519().NewPublicKey(grant.ReplyTo)
+	if err != nil {
+		return err
+	}
+
+	// they're in the room, even if we didn't know - they might have joined through someone else
+	room.lock.Lock()
+	if _, ok := room.participants[msg.Sender]; !ok {
+		room.participants[msg.Sender] = from
+	}
+	room.replyTo[msg.Sender] = replyTo
+	room.lock.Unlock()
+	room.identify(msg)
+
+	room.confirm(msg.Sender, grant.Have)
+
+	var opened, added bool
+	if len(grant.Sealed) > 0 {
+		if added, err = c.openSenderKey(room, msg.Sender, grant); err != nil {
+			log.Printf("Unable to open the sender key from %x in %s: %s", msg.Sender, room.ID, err)
+		} else {
+			opened = true
+		}
+	}
+
+	// an unsealed grant wants a reply key, and one we couldn't open means we ask for theirs again. A chain that's new
+	// to us is answered too, so they know we have it
+	if opened && !added && !grant.NeedKey && room.hasOurKey(msg.Sender) {
+		return nil
+	}
+	return c.grantSenderKey(room, msg.Sender, !opened)
+}
+
+// openSenderKey opens a grant from the sender with the reply key it was sealed to, and takes on the chain in it. It says
+// whether the chain's new to us
+func (c *client) openSenderKey(room *chatroom, sender string, grant senderKeyGrant) (bool, error) {
+	replyKey, ok := room.takeReplyKey(sender, grant.SealedTo)
+	if !ok {
+		return false, errNoReplyKey
+	}
+	b, err := openGrant(room.ID, sender, string(c.Node.ID), replyKey, grant)
+	if err != nil {
+		return false, err
+	}
+	defer wipe(b)
+
+	var sk senderKey
+	if err := msgpack.Unmarshal(b, &sk); err != nil {
+		return false, err
+	}
+	if len(sk.ChainKey) != CHAIN_KEY_SIZE {
+		return false, fmt.Errorf("chain key is %d bytes. Expected %d", len(sk.ChainKey), CHAIN_KEY_SIZE)
+	}
+	if !room.addChain(sender, sk) {
+		wipe(sk.ChainKey)
+		return false, nil
+	}
+	room.expect(sender, sk.Sequence)
+	return true, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+// a sender key grant opens for whoever it's for, and from whoever it's from
+func TestSenderKeyGrant(t *testing.T) {
+	room := newChatroom("room", nil, nil, nil)
+	replyKey, err := room.replyKey("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := room.replyKey("a"); again != replyKey {
+		t.Fatal("the reply key should stay the same until it's used")
+	}
+
+	ephemeral, sealed, err := sealGrant("room", "a", "b", replyKey.PublicKey(), []byte("chain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grant := senderKeyGrant{To: "b", Ephemeral: ephemeral, SealedTo: replyKey.PublicKey().Bytes(), Sealed: sealed}
+
+	if _, err := openGrant("room", "m", "b", replyKey, grant); err == nil {
+		t.Error("the grant opened as if it was from someone else")
+	}
+	if _, err := openGrant("other room", "a", "b", replyKey, grant); err == nil {
+		t.Error("the grant opened for another room")
+	}
+	if _, ok := room.takeReplyKey("m", grant.SealedTo); ok {
+		t.Error("a's reply key was taken for someone else")
+	}
+
+	key, ok := room.takeReplyKey("a", grant.SealedTo)
+	if !ok {
+		t.Fatal("the reply key is gone")
+	}
+	b, err := openGrant("room", "a", "b", key, grant)
+	if err != nil || string(b) != "chain" {
+		t.Fatalf("expected the chain. Got %q, %v", b, err)
+	}
+	next, _ := room.replyKey("a")
+	if next == replyKey {
+		t.Error("a used reply key is handed out again")
+	}
+
+	// a grant that was sealed to it before the new one got there still opens
+	if _, ok := room.takeReplyKey("a", grant.SealedTo); !ok {
+		t.Error("the reply key before the current one should still be there")
+	}
+}
+
+// once the next reply key's used, the one before it's gone
+func TestReplyKeysAreDropped(t *testing.T) {
+	room := newChatroom("room", nil, nil, nil)
+
+	first, _ := room.replyKey("a")
+	room.takeReplyKey("a", first.PublicKey().Bytes())
+	second, _ := room.replyKey("a")
+	if _, ok := room.takeReplyKey("a", second.PublicKey().Bytes()); !ok {
+		t.Fatal("the current reply key should be taken")
+	}
+	if _, ok := room.takeReplyKey("a", first.PublicKey().Bytes()); ok {
+		t.Error("the reply key from two keys ago is still there")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// signatures: every message is signed with the sender's member key, and checked against the room's group key.
+// A group signature only says that *a* member signed it, not which one - but that's not what says who sent it: that's the
+// identity sealed in with the body (see identity.go). What it's for is keeping out anyone who isn't a member, and letting
+// whoever holds the group private key open it, to see which member key it was.
+// What's signed is the header and the sealed body, so the signature can be checked before anything's decrypted
+var errBadSignature = errors.New("message is not signed by a member of the room")
+
+// signedDigest is the digest of everything the signature covers
+func signedDigest(msg Message) []byte {
+	h := sha256.New()
+	h.Write(associatedData(msg))
+	h.Write(msg.Message)
+	return h.Sum(nil)
+}
+
+// sign returns a copy of the message, signed with our member key. The message should be sealed first
+func (room *chatroom) sign(msg Message) (Message, error) {
+	sig, err := room.memberPrivateKey.Sign(rand.Reader, signedDigest(msg), sha256.New())
+	if err != nil {
+		return msg, err
+	}
+	msg.Signature = sig
+	return msg, nil
+}
+
+// verify checks that the message was signed by a member of the room
+func (room *chatroom) verify(msg Message) error {
+	if len(msg.Signature) == 0 || !room.groupPublicKey.Verify(signedDigest(msg), sha256.New(), msg.Signature) {
+		return errBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+// an outsider that's got hold of the room key still can't get a message in: without a member key, it's dropped before
+// it's opened
+func TestBadSignatureIsDropped(t *testing.T) {
+	room := createChatroom()
+	outsiders := createChatroom()
+	outsiders.ID, outsiders.roomKey = room.ID, room.roomKey
+	alice, mallory := newMember(t), newMember(t)
+
+	cases := []struct {
+		name   string
+		secure func() (Message, error)
+	}{
+		{"another group's member key", func() (Message, error) {
+			msg, _ := mallory.newControl(room, AckMessage, ackBody{"x"})
+			return mallory.secure(outsiders, msg)
+		}},
+		{"unsigned", func() (Message, error) {
+			msg, _ := mallory.newControl(room, AckMessage, ackBody{"x"})
+			msg, err := mallory.secure(room, msg)
+			msg.Signature = nil
+			return msg, err
+		}},
+		{"signed, then changed", func() (Message, error) {
+			msg, _ := alice.newControl(room, AckMessage, ackBody{"x"})
+			msg, err := alice.secure(room, msg)
+			msg.Lamport++
+			return msg, err
+		}},
+		{"garbage that's never opened", func() (Message, error) {
+			msg, _ := mallory.newControl(room, AckMessage, ackBody{"x"})
+			msg.Message = []byte("not sealed at all")
+			return outsiders.sign(msg)
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := tc.secure()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := room.authenticate(msg); err != errBadSignature {
+				t.Errorf("expected %q. Got %v", errBadSignature, err)
+			}
+		})
+	}
+
+	room.lock.Lock()
+	bound := len(room.publicKeys)
+	room.lock.Unlock()
+	if bound != 0 {
+		t.Error("an identity was bound off a message that was dropped")
+	}
+
+	// a member's is fine
+	msg, _ := alice.newControl(room, AckMessage, ackBody{"x"})
+	if msg, err := alice.secure(room, msg); err != nil {
+		t.Fatal(err)
+	} else if _, err := room.authenticate(msg); err != nil {
+		t.Errorf("a member's message was dropped: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package sim
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const PING_TIMEOUT = 5 * time.Second // how long a ping gets, retries included, before it counts as not delivered
+
+// LookupResult is how a batch of lookups went
+type LookupResult struct {
+	Lookups int
+	Found   int
+	Hops    []int // one per lookup that found its target
+}
+
+func (r LookupResult) SuccessRate() float64 {
+	if r.Lookups == 0 {
+		return 0
+	}
+	return float64(r.Found) / float64(r.Lookups)
+}
+
+func (r LookupResult) MeanHops() float64 {
+	if len(r.Hops) == 0 {
+		return 0
+	}
+	total := 0
+	for _, h := range r.Hops {
+		total += h
+	}
+	return float64(total) / float64(len(r.Hops))
+}
+
+func (r LookupResult) MaxHops() int {
+	max := 0
+	for _, h := range r.Hops {
+		if h > max {
+			max = h
+		}
+	}
+	return max
+}
+
+// Lookups has n random live nodes each look up the ID of another random live node.
+// A lookup succeeds if the target is amongst the nodes found
+func (s *Sim) Lookups(n int) LookupResult {
+	var r LookupResult
+	for i := 0; i < n; i++ {
+		from, to, ok := s.pair()
+		if !ok {
+			break
+		}
+
+		r.Lookups++
+		closest, stats := from.FindNodeStats(context.Background(), to.Node.ID)
+		for _, c := range closest {
+			if c.ID.EqualsTo(to.Node.ID) {
+				r.Found++
+				r.Hops = append(r.Hops, stats.Hops)
+				break
+			}
+		}
+	}
+	return r
+}
+
+// DeliveryResult is how a batch of messages went
+type DeliveryResult struct {
+	Sent      int
+	Delivered int
+}
+
+func (r DeliveryResult) Rate() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Delivered) / float64(r.Sent)
+}
+
+// Pings has n random live nodes each ping another random live node, straight by address, as the chat client does when it
+// talks to a room member. A ping is delivered if it's answered in time, retries and all
+func (s *Sim) Pings(n int) DeliveryResult {
+	var r DeliveryResult
+	for i := 0; i < n; i++ {
+		from, to, ok := s.pair()
+		if !ok {
+			break
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), PING_TIMEOUT)
+		r.Sent++
+		if call := <-from.PingIP(ctx, to.Addr).Done; call.Error == nil {
+			r.Delivered++
+		}
+		cancel()
+	}
+	return r
+}
+
+// AssertLookups fails the test if too few lookups found their targets, or if they took too many hops on average
+func AssertLookups(t testing.TB, r LookupResult, minSuccessRate, maxMeanHops float64) {
+	t.Helper()
+	if r.SuccessRate() < minSuccessRate {
+		t.Errorf("%d of %d lookups found their target (%.2f). Expected at least %.2f", r.Found, r.Lookups, r.SuccessRate(), minSuccessRate)
+	}
+	if r.MeanHops() > maxMeanHops {
+		t.Errorf("Lookups took %.2f hops on average (max %d). Expected at most %.2f", r.MeanHops(), r.MaxHops(), maxMeanHops)
+	}
+}
+
+// AssertDelivery fails the test if too few messages were delivered
+func AssertDelivery(t testing.TB, r DeliveryResult, minRate float64) {
+	t.Helper()
+	if r.Rate() < minRate {
+		t.Errorf("%d of %d messages were delivered (%.2f). Expected at least %.2f", r.Delivered, r.Sent, r.Rate(), minRate)
+	}
+}
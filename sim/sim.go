@@ -0,0 +1,247 @@
+// Package sim runs a whole kademlia network in one process, over an in-memory transport, so protocol changes can be
+// tried out (and regression tested) without launching a pile of nanjingtaxi binaries by hand.
+//
+// Nodes can be added and killed at any time, the network can be made lossy, partitioned or NATed, and the clock only moves
+// when it's told to. The chat client lives in package main, so this package can't start one by itself. Instead, anything
+// built on top of the DHT gets a transport of its own on a node's address (with Listen), and registers its handlers on
+// the node (with Handle), the same way the client does on a real one - package main's tests put chat clients on simulated
+// nodes like that, and check their messages get through with AssertDelivery
+package sim
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chewxy/nanjingtaxi/kademlia"
+)
+
+const (
+	SIM_PORT          = 7000                   // every simulated node listens on this port, on its own IP
+	SIM_TIMEOUT       = 200 * time.Millisecond // RPC timeout of the simulated nodes. The network's in memory, so this can be short
+	BOOTSTRAP_SEEDS   = 3                      // how many live nodes a new node bootstraps off
+	BOOTSTRAP_TIMEOUT = 30 * time.Second
+)
+
+// Clock is a clock that only moves when it's told to. Every node in a simulation goes by it
+type Clock struct {
+	now  time.Time
+	lock sync.Mutex
+}
+
+func NewClock(start time.Time) *Clock { return &Clock{now: start} }
+
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *Clock) advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.lock.Unlock()
+}
+
+// Node is a simulated node
+type Node struct {
+	*kademlia.Kademlia
+	Addr *net.UDPAddr
+
+	alive      bool
+	transports []kademlia.Transport // the ones from Listen, closed along with the node
+}
+
+// Sim is a simulated network. Only one can run at a time, as the clock is shared by the whole kademlia package
+type Sim struct {
+	Network *kademlia.MemoryNetwork
+	Clock   *Clock
+
+	nodes []*Node
+	rand  *rand.Rand
+
+	sinceReannounce time.Duration
+	previousClock   kademlia.Clock // put back on Close
+
+	lock sync.Mutex
+}
+
+// New starts a simulation with n nodes. Each node bootstraps off a few of the ones started before it.
+// The seed decides the addresses picked, which nodes churn and which packets are lost
+func New(n int, seed int64) *Sim {
+	s := &Sim{
+		Network: kademlia.NewMemoryNetwork(seed),
+		Clock:   NewClock(time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)),
+		rand:    rand.New(rand.NewSource(seed)),
+	}
+	s.previousClock = kademlia.SetClock(s.Clock)
+
+	for i := 0; i < n; i++ {
+		s.AddNode()
+	}
+	return s
+}
+
+// AddNode starts a new node and bootstraps it off a few random live nodes
+func (s *Sim) AddNode() *Node { return s.AddNodeWithID(nil) }
+
+// AddNodeWithID is AddNode, for a node that has to have the ID - chat clients' IDs are made from their identities. Nil
+// means a random one
+func (s *Sim) AddNodeWithID(id kademlia.NodeID) *Node {
+	s.lock.Lock()
+	i := len(s.nodes)
+	addr := &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: SIM_PORT}
+	var seeds []string
+	for _, j := range s.rand.Perm(len(s.nodes)) {
+		if len(seeds) == BOOTSTRAP_SEEDS {
+			break
+		}
+		if s.nodes[j].alive {
+			seeds = append(seeds, s.nodes[j].Addr.String())
+		}
+	}
+	s.lock.Unlock()
+
+	transport, err := s.Network.Listen(addr)
+	if err != nil {
+		panic(err) // addresses are never reused, so this is a bug
+	}
+
+	k := kademlia.NewKademlia()
+	if id != nil {
+		k.Node.ID = id
+	}
+	k.Name = fmt.Sprintf("sim%d", i)
+	k.Transport = kademlia.NewFramedTransport(transport)
+	k.Timeout = SIM_TIMEOUT
+	go k.Run()
+
+	node := &Node{Kademlia: k, Addr: addr, alive: true}
+	s.lock.Lock()
+	s.nodes = append(s.nodes, node)
+	s.lock.Unlock()
+
+	if len(seeds) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), BOOTSTRAP_TIMEOUT)
+		k.Bootstrap(ctx, seeds)
+		cancel()
+	}
+	return node
+}
+
+// Nodes returns the live nodes
+func (s *Sim) Nodes() []*Node {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var retVal []*Node
+	for _, n := range s.nodes {
+		if n.alive {
+			retVal = append(retVal, n)
+		}
+	}
+	return retVal
+}
+
+// Listen gives the node another transport, on its own address at the port, for whatever runs alongside the DHT on it -
+// like a chat client's room messages. It goes when the node's killed
+func (s *Sim) Listen(n *Node, port int) (kademlia.Transport, error) {
+	transport, err := s.Network.Listen(&net.UDPAddr{IP: n.Addr.IP, Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	n.transports = append(n.transports, transport)
+	s.lock.Unlock()
+	return transport, nil
+}
+
+// Kill takes a node off the network for good, without it saying goodbye
+func (s *Sim) Kill(n *Node) {
+	s.lock.Lock()
+	n.alive = false
+	transports := n.transports
+	n.transports = nil
+	s.lock.Unlock()
+
+	n.Close()
+	for _, transport := range transports {
+		transport.Close()
+	}
+}
+
+// Churn kills n random live nodes, and starts n new ones in their place
+func (s *Sim) Churn(n int) {
+	nodes := s.Nodes()
+
+	s.lock.Lock()
+	perm := s.rand.Perm(len(nodes))
+	s.lock.Unlock()
+
+	for i := 0; i < n && i < len(perm); i++ {
+		s.Kill(nodes[perm[i]])
+	}
+	for i := 0; i < n; i++ {
+		s.AddNode()
+	}
+}
+
+// SetNAT puts the node behind a NAT, so the other nodes can't reach it unless it's reached them first
+func (s *Sim) SetNAT(n *Node, behind bool) { s.Network.SetNAT(n.Addr, behind) }
+
+// Advance moves the clock forward. It's done in steps of at most MAINTENANCE_INTERVAL, and every live node does its
+// maintenance after each step (and its reannouncements when they're due), same as Run would have if the time had really passed
+func (s *Sim) Advance(d time.Duration) {
+	for d > 0 {
+		step := d
+		if step > kademlia.MAINTENANCE_INTERVAL {
+			step = kademlia.MAINTENANCE_INTERVAL
+		}
+		d -= step
+		s.Clock.advance(step)
+
+		s.sinceReannounce += step
+		reannounce := s.sinceReannounce >= kademlia.REANNOUNCE_INTERVAL
+		if reannounce {
+			s.sinceReannounce = 0
+		}
+
+		var wg sync.WaitGroup
+		for _, n := range s.Nodes() {
+			wg.Add(1)
+			go func(n *Node) {
+				defer wg.Done()
+				n.Maintain()
+				if reannounce {
+					n.Reannounce()
+				}
+			}(n)
+		}
+		wg.Wait()
+	}
+}
+
+// Close kills every node, and puts back the clock the kademlia package had before
+func (s *Sim) Close() {
+	for _, n := range s.Nodes() {
+		s.Kill(n)
+	}
+	kademlia.SetClock(s.previousClock)
+}
+
+// pair picks two different random live nodes
+func (s *Sim) pair() (from, to *Node, ok bool) {
+	nodes := s.Nodes()
+	if len(nodes) < 2 {
+		return nil, nil, false
+	}
+
+	s.lock.Lock()
+	perm := s.rand.Perm(len(nodes))
+	s.lock.Unlock()
+	return nodes[perm[0]], nodes[perm[1]], true
+}
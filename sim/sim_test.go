@@ -0,0 +1,92 @@
+package sim
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chewxy/nanjingtaxi/kademlia"
+)
+
+func TestLookupsUnderChurn(t *testing.T) {
+	if testing.Short() {
+		t.Skip("new nodes take a while to bootstrap past the dead ones")
+	}
+	s := New(30, 1)
+	defer s.Close()
+
+	AssertLookups(t, s.Lookups(20), 0.95, 4)
+	AssertDelivery(t, s.Pings(20), 1)
+
+	// a couple of hours of churn and a lossy network later, lookups still get there
+	s.Churn(3)
+	s.Network.SetLoss(0.05)
+	s.Advance(2 * time.Hour)
+	AssertLookups(t, s.Lookups(20), 0.9, 4)
+}
+
+func TestListen(t *testing.T) {
+	s := New(2, 2)
+	defer s.Close()
+	a, b := s.Nodes()[0], s.Nodes()[1]
+
+	ta, err := s.Listen(a, SIM_PORT+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := s.Listen(b, SIM_PORT+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ta.LocalAddr().IP.Equal(a.Addr.IP) {
+		t.Fatalf("the transport is on %s. Expected it on %s", ta.LocalAddr(), a.Addr.IP)
+	}
+
+	if err := ta.Send([]byte("hello"), tb.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	got, from, err := tb.Receive()
+	if err != nil || string(got) != "hello" || from.String() != ta.LocalAddr().String() {
+		t.Fatalf("expected hello from %s. Got %q from %s (%v)", ta.LocalAddr(), got, from, err)
+	}
+
+	// and it goes with the node
+	s.Kill(b)
+	if _, _, err := tb.Receive(); err == nil {
+		t.Error("the transport should be closed along with the node")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if call := <-a.PingIP(ctx, b.Addr).Done; call.Error == nil {
+		t.Error("a killed node answered a ping")
+	}
+}
+
+// the simulated clock doesn't outlive the simulation
+func TestCloseRestoresClock(t *testing.T) {
+	s := New(2, 3)
+	s.Close()
+
+	mn := kademlia.NewMemoryNetwork(3)
+	var nodes []*kademlia.Kademlia
+	for i := 1; i <= 2; i++ {
+		k := kademlia.NewKademlia()
+		var err error
+		if k.Transport, err = mn.Listen(&net.UDPAddr{IP: net.IPv4(10, 1, 0, byte(i)), Port: SIM_PORT}); err != nil {
+			t.Fatal(err)
+		}
+		go k.Run()
+		defer k.Close()
+		nodes = append(nodes, k)
+	}
+
+	call := <-nodes[0].PingIP(context.Background(), nodes[1].Transport.LocalAddr()).Done
+	if call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	if heard := call.Remote.LastResponded(); time.Since(heard) > time.Minute {
+		t.Errorf("the pong was heard at %s, which is the simulation's time, not now", heard)
+	}
+}